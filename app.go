@@ -0,0 +1,427 @@
+package gonetworktest
+
+// App is everything an App needs for talking over the Hub: listening to the Hub broadcast, filling
+// gaps from a Gob, dispatching received App messages by type, and sending App messages reliably.
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrAppStopped is returned when sending with an App that isn't running
+var ErrAppStopped = errors.New("App is not running")
+
+// ErrPayloadTooLarge is returned when sending a payload that can't fit in a Hub message
+var ErrPayloadTooLarge = errors.New("payload too large for a Hub message")
+
+// App runs the Hub receive loop of an App in a goroutine of its own. Received App messages are
+// dispatched with Registry, from that goroutine.
+type App struct {
+	Configuration Configuration
+	State         AppState
+	HubData       HubCommData
+	Registry      MessageTypeRegistry
+	Transport     Transport
+	// DeliverOwnMessages makes our own App messages coming back from the Hub get dispatched too.
+	// Either way, they acknowledge the send queue.
+	DeliverOwnMessages bool
+	// StopTimeout is how long StopApp waits for the Hub to accept the App messages already sent
+	StopTimeout   time.Duration
+	sendData      AppCommData
+	connection    net.Conn
+	pc            net.PacketConn
+	gobConnection net.PacketConn
+	hubAddress    net.Addr    // Where to register, if the Hub does unicast fan-out
+	frames        chan []byte // From a Gob
+	liveFrames    chan []byte // From the Hub
+	caughtUp      chan error
+	stop          chan struct{}
+	stopped       chan bool
+	wake          chan bool
+	// Guards what follows, which SendApp may touch from other goroutines
+	mutex        sync.Mutex
+	running      bool
+	backlog      []appSend // Waiting for room in the send queue
+	nextSequence uint64
+	pendingSends int
+	// The first App sequence number of this run, and the Hub sessions a SessionStart was last sent
+	// in, and last seen in. Until the Hub of the current session has sequenced one of our App
+	// messages, SessionStart is sent again with every retransmit.
+	runStart         uint64
+	announcedSession uint64
+	confirmed        bool
+	confirmedSession uint64
+	// Where the first Hub message, or heartbeat, heard from the Hub was. Anything before it was sent
+	// before the App started.
+	liveStartKnown bool
+	liveSession    uint64
+	liveSequence   uint64
+}
+
+// appSend is an App message waiting to be sent
+type appSend struct {
+	messageType uint16
+	payload     []byte
+}
+
+// InitApp initializes an App with the given ID. Register message types with SubscribeApp, and set
+// the callbacks of HubData, before starting it.
+func InitApp(app *App, ID uint64, configuration Configuration) {
+	app.Configuration = configuration
+	app.State = InitAppState(ID, configuration)
+	InitHubMessage(&app.HubData)
+	InitMessageTypeRegistry(&app.Registry)
+	app.Transport = ConfiguredTransport(configuration)
+	InitAppMessage(&app.sendData)
+	app.DeliverOwnMessages = false
+	app.HubData.SessionChanged = func(oldSessionID uint64, newSessionID uint64) {
+		log.Print("Hub session changed from ", oldSessionID, " to ", newSessionID)
+	}
+	app.HubData.LivenessChanged = func(alive bool) {
+		if alive {
+			log.Print("Hub is alive")
+		} else {
+			log.Print("Nothing heard from Hub for ", app.HubData.HubTimeout)
+		}
+	}
+	app.HubData.GapUnrecoverable = func(sessionID uint64, fromSequence uint64, toSequence uint64) {
+		log.Print("Gave up on Hub messages ", fromSequence, "-", toSequence, " of session ", sessionID, ", which no Gob sent")
+	}
+	if configuration.AppHubTimeoutMilliseconds > 0 {
+		app.HubData.HubTimeout = time.Duration(configuration.AppHubTimeoutMilliseconds) * time.Millisecond
+	}
+	if configuration.AppGapTimeoutMilliseconds > 0 {
+		app.HubData.GapTimeout = time.Duration(configuration.AppGapTimeoutMilliseconds) * time.Millisecond
+	}
+	app.StopTimeout = AppStopDefaultTimeout
+	if configuration.AppStopTimeoutMilliseconds > 0 {
+		app.StopTimeout = time.Duration(configuration.AppStopTimeoutMilliseconds) * time.Millisecond
+	}
+	app.backlog = make([]appSend, 0)
+	app.nextSequence = 0
+	app.pendingSends = 0
+}
+
+// SubscribeApp registers the handler, and optionally a decoder, for a type of received App messages
+func SubscribeApp(app *App, messageType uint16, name string, handler MessageHandler, decoder MessageDecoder) error {
+	return RegisterMessageType(&app.Registry, messageType, name, handler, decoder)
+}
+
+// StartApp connects to the Hub and a Gob, and starts receiving. If AppCatchUpOnStart is set, the
+// history of the latest session is fetched from a Gob first. Returns an error if the configuration
+// isn't valid, or the connections couldn't be set up.
+func StartApp(app *App) error {
+	err := ValidateConfiguration(app.Configuration)
+	if err != nil {
+		return err
+	}
+	if app.Configuration.HubUnicastFanOut {
+		app.hubAddress, err = net.ResolveUDPAddr("udp", app.Configuration.AppRiseAddress)
+		if err != nil {
+			return err
+		}
+	}
+	app.connection, err = app.Transport.DialPacket(app.Configuration.AppRiseAddress)
+	if err != nil {
+		return err
+	}
+
+	app.pc, err = app.Transport.ListenPacket(app.Configuration.AppSinkAddress)
+	if err != nil {
+		app.connection.Close()
+		return err
+	}
+
+	// Every run of an App numbers its App messages from the time it started, so they are always
+	// higher than those of an earlier run with the same ID, and the Hub can be told to skip ahead
+	app.runStart = uint64(time.Now().UnixNano())
+	app.nextSequence = app.runStart
+	app.sendData.AppSequenceNumber = app.runStart
+	app.backlog = app.backlog[:0]
+	app.pendingSends = 0
+	InitSendQueue(&app.State.SendQueue, SendQueueSizeInitialSize, app.State.SendQueue.MaxCapacity)
+	app.confirmed = false
+	app.liveStartKnown = false
+
+	// Hub messages arrive both from the Hub, and from a Gob when filling gaps. Closing stop keeps
+	// whatever passes them on from waiting for the receive loop after it is gone.
+	app.frames = make(chan []byte, 128)
+	app.liveFrames = make(chan []byte, 128)
+	app.stop = make(chan struct{})
+	app.gobConnection, err = ConnectGobRequests(app.Transport, app.Configuration, &app.HubData, app.frames, app.stop)
+	if err != nil {
+		app.pc.Close()
+		app.connection.Close()
+		return err
+	}
+	go ReceiveHubFrames(app.pc, app.liveFrames, app.stop)
+	if app.hubAddress != nil {
+		registerApp(app)
+	}
+
+	// Fetch the history of the session from a Gob before going live. Live messages are kept as
+	// pending meanwhile, and delivered once the history has caught up with them.
+	app.caughtUp = make(chan error, 1)
+	if app.Configuration.AppCatchUpOnStart {
+		app.HubData.CatchingUp = true
+		go func() { app.caughtUp <- CatchUpFromGob(app.Transport, app.Configuration, app.frames, app.stop) }()
+	}
+
+	app.stopped = make(chan bool)
+	app.wake = make(chan bool, 1)
+	app.mutex.Lock()
+	app.running = true
+	app.mutex.Unlock()
+	go runApp(app)
+	return nil
+}
+
+// StopApp takes no more App messages, and waits up to StopTimeout for the Hub to accept the ones
+// already sent, before it stops receiving, and closes the connections. Returns the number of App
+// messages the Hub hadn't accepted by then, which are dropped.
+func StopApp(app *App) int {
+	app.mutex.Lock()
+	if !app.running {
+		app.mutex.Unlock()
+		return 0
+	}
+	app.running = false
+	app.mutex.Unlock()
+	// The receive loop goes on sending the backlog, and retransmitting, until then
+	deadline := time.Now().Add(app.StopTimeout)
+	for AppSendsPending(app) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(app.stop)
+	<-app.stopped
+	app.gobConnection.Close()
+	app.pc.Close()
+	app.connection.Close()
+	dropped := AppSendsPending(app)
+	if dropped > 0 {
+		log.Print("Dropped ", dropped, " App messages the Hub hadn't accepted")
+	}
+	return dropped
+}
+
+// SendApp sends an App message of the given type, and returns the App sequence number it gets. The
+// message is sent reliably, but if too many messages are already in flight, it waits its turn.
+// Returns ErrSendQueueFull if SendQueueMaxCapacity messages are already waiting, ErrPayloadTooLarge
+// if the payload is longer than MaxAppPayloadSize, and ErrMessageTypeReserved for a system message
+// type that isn't sent from App to App. It may be called from any goroutine, including from message
+// handlers.
+func SendApp(app *App, messageType uint16, payload []byte) (uint64, error) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	if !app.running {
+		return 0, ErrAppStopped
+	}
+	if len(payload) > MaxAppPayloadSize {
+		return 0, ErrPayloadTooLarge
+	}
+	if IsSystemMessageType(messageType) && !IsSequencedSystemMessageType(messageType) {
+		return 0, ErrMessageTypeReserved
+	}
+	if len(app.backlog) >= app.State.SendQueue.MaxCapacity {
+		return 0, ErrSendQueueFull
+	}
+	sequence := app.nextSequence
+	app.nextSequence++
+	app.backlog = append(app.backlog, appSend{messageType: messageType, payload: append([]byte(nil), payload...)})
+	app.pendingSends++
+	select {
+	case app.wake <- true:
+	default:
+	}
+	return sequence, nil
+}
+
+// AppReplaying tells if the App message being handled was sent before the App started, and is only
+// delivered because the App caught up from a Gob. Handlers with side effects, like replying, should
+// skip replayed App messages. Only call it from handlers.
+func AppReplaying(app *App) bool {
+	if !app.liveStartKnown {
+		return true
+	}
+	if app.HubData.ExpectedSessionID != app.liveSession {
+		return app.HubData.ExpectedSessionID < app.liveSession
+	}
+	return app.HubData.ExpectedHubSequenceNumber < app.liveSequence
+}
+
+// AppSendsPending returns the number of App messages sent that the Hub hasn't accepted yet
+func AppSendsPending(app *App) int {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	return app.pendingSends
+}
+
+// runApp is the receive loop of an App
+func runApp(app *App) {
+	defer close(app.stopped)
+	var appData AppCommData
+	InitAppMessage(&appData)
+	var appMessages AppMessageIterator
+	malformedFrames := 0
+
+	// Ask again for missing messages, and check that the Hub is alive, even if no new Hub messages arrive
+	gapTicker := time.NewTicker(GapRequestTimeout)
+	defer gapTicker.Stop()
+	retransmitTicker := time.NewTicker(AppRetransmitTimeout)
+	defer retransmitTicker.Stop()
+	var registrationTick <-chan time.Time // Never fires without unicast fan-out
+	if app.hubAddress != nil {
+		registrationTicker := time.NewTicker(HubRegistrationInterval(app.Configuration))
+		defer registrationTicker.Stop()
+		registrationTick = registrationTicker.C
+	}
+	announceApp(app)
+
+	receive := func(frame []byte) {
+		app.HubData.MasterBuffer = frame
+		ok, err := DecodeHubMessage(&app.HubData)
+		if err != nil {
+			malformedFrames++
+			log.Print("Malformed Hub message number ", malformedFrames, ": ", err)
+		}
+		deliverHubMessages(app, ok, &appMessages, &appData)
+		// A new Hub may not know where we are
+		if !appConfirmed(app) && app.announcedSession != newestHubSession(&app.HubData) {
+			announceApp(app)
+		}
+	}
+
+	for {
+		select {
+		case <-app.stop:
+			return
+		case <-app.wake:
+		case <-retransmitTicker.C:
+			RetransmitAppMessages(&app.State, app.connection)
+			if !appConfirmed(app) {
+				announceApp(app)
+			}
+		case <-registrationTick:
+			registerApp(app)
+		case <-gapTicker.C:
+			// Also goes on with a newer session, if the current one can't be completed
+			deliverHubMessages(app, NextPendingHubMessage(&app.HubData), &appMessages, &appData)
+			CheckHubLiveness(&app.HubData)
+		case err := <-app.caughtUp:
+			if err != nil {
+				log.Print("Could not catch up from Gob: ", err)
+			}
+			app.HubData.CatchingUp = false
+			deliverHubMessages(app, NextPendingHubMessage(&app.HubData), &appMessages, &appData)
+		case frame := <-app.frames:
+			receive(frame)
+		case frame := <-app.liveFrames:
+			// Anything before the first Hub message heard from the Hub is only replayed
+			app.HubData.MasterBuffer = frame
+			if !app.liveStartKnown && DecodeHubHeader(&app.HubData) == nil && app.HubData.SessionID >= app.HubData.ExpectedSessionID {
+				app.liveStartKnown = true
+				app.liveSession = app.HubData.SessionID
+				app.liveSequence = app.HubData.HubSequenceNumber
+			}
+			receive(frame)
+		}
+		sendBacklog(app)
+	}
+}
+
+// deliverHubMessages delivers the Hub message just decoded, if ok, and any pending messages that
+// are now in sequence
+func deliverHubMessages(app *App, ok bool, appMessages *AppMessageIterator, appData *AppCommData) {
+	for ; ok; ok = NextPendingHubMessage(&app.HubData) {
+		// A Hub message may carry several App messages, one after the other
+		InitAppMessageIterator(appMessages, &app.HubData)
+		for NextAppMessage(appMessages, appData) {
+			deliverAppMessage(app, appData)
+		}
+		if appMessages.Err != nil {
+			log.Print("Malformed Hub message ", app.HubData.HubSequenceNumber, ": ", appMessages.Err)
+		}
+		app.HubData.ExpectedHubSequenceNumber++
+	}
+}
+
+// newestHubSession returns the newest Hub session heard from, which may still be waiting for the
+// current one to be complete
+func newestHubSession(data *HubCommData) uint64 {
+	if data.NextSessionID > data.ExpectedSessionID {
+		return data.NextSessionID
+	}
+	return data.ExpectedSessionID
+}
+
+// registerApp asks the Hub to keep sending Hub messages to where the App listens
+func registerApp(app *App) {
+	if err := SendHubRegistration(app.pc, app.hubAddress, app.State.ID); err != nil {
+		log.Print("Could not register with Hub: ", err)
+	}
+}
+
+// announceApp sends a SessionStart, telling the Hub which App sequence number comes next from us
+func announceApp(app *App) {
+	next := app.sendData.AppSequenceNumber
+	if app.State.SendQueue.Length > 0 {
+		next = app.State.SendQueue.HeadSequenceNumber
+	}
+	if err := SendSessionStart(app.connection, app.State.ID, next); err != nil {
+		log.Print("Could not send session start: ", err)
+	}
+	app.announcedSession = newestHubSession(&app.HubData)
+}
+
+// appConfirmed tells if the Hub of the current session has sequenced an App message of this run
+func appConfirmed(app *App) bool {
+	return app.confirmed && app.confirmedSession == app.HubData.ExpectedSessionID
+}
+
+// deliverAppMessage acknowledges our own App messages, and dispatches the App message
+func deliverAppMessage(app *App, appData *AppCommData) {
+	// Only App messages of this run say anything about what we sent. Earlier runs with the same ID
+	// used lower App sequence numbers.
+	if appData.ID == app.State.ID {
+		if appData.AppSequenceNumber >= app.runStart {
+			app.confirmed = true
+			app.confirmedSession = app.HubData.ExpectedSessionID
+			if err := AcknowledgeAppMessage(&app.State, appData); err != nil {
+				log.Print("Not acknowledging App message ", appData.AppSequenceNumber, ": ", err)
+			}
+		}
+		if !app.DeliverOwnMessages {
+			return
+		}
+	}
+	if err := DispatchAppMessage(&app.Registry, appData); err != nil {
+		log.Print("Bad message from App ", appData.ID, ": ", err)
+	}
+}
+
+// sendBacklog sends waiting App messages, oldest first, for as long as the send queue has room
+func sendBacklog(app *App) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	sent := 0
+	for _, send := range app.backlog {
+		if app.State.SendQueue.Length >= app.State.MaxSendsInFlight {
+			break
+		}
+		app.sendData.Type = send.messageType
+		app.sendData.Payload = send.payload
+		if err := QueueAppMessage(&app.State, &app.sendData, app.connection); err != nil {
+			log.Print("Could not send App message ", app.sendData.AppSequenceNumber, ": ", err)
+			break
+		}
+		sent++
+	}
+	if sent == len(app.backlog) {
+		app.backlog = app.backlog[:0]
+	} else {
+		app.backlog = app.backlog[sent:]
+	}
+	app.pendingSends = len(app.backlog) + app.State.SendQueue.Length
+}
@@ -0,0 +1,318 @@
+package gonetworktest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startMemoryHub runs a Hub over the transport until the context is done
+func startMemoryHub(ctx context.Context, t *testing.T, transport Transport, configuration Configuration, running *sync.WaitGroup) *Hub {
+	var hub Hub
+	InitHub(&hub, configuration)
+	hub.Transport = transport
+	hub.Logger = log.New(io.Discard, "", 0)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		if err := RunHub(ctx, &hub); err != nil {
+			t.Error("Hub failed: ", err)
+		}
+	}()
+	return &hub
+}
+
+// startMemoryGob runs a Gob over the transport until the context is done. It returns once the Gob
+// listens, so that it hears every Hub message of a Hub started after it.
+func startMemoryGob(ctx context.Context, t *testing.T, transport Transport, configuration Configuration, running *sync.WaitGroup) {
+	var gob Gob
+	InitGob(&gob, configuration)
+	gob.Transport = transport
+	gob.Logger = log.New(io.Discard, "", 0)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		if err := RunGob(ctx, &gob); err != nil {
+			t.Error("Gob failed: ", err)
+		}
+	}()
+	if err := WaitForGob(transport, configuration, 5*time.Second); err != nil {
+		t.Fatal("Gob didn't start listening: ", err)
+	}
+}
+
+// waitFor waits until the condition holds, and tells if it did before the timeout
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// TestHubAppGobOverMemoryTransport runs a Hub, a Gob and four Apps in the test. One App sends, one
+// replies to requests, one starts late and catches up from the Gob, and one starts late without.
+func TestHubAppGobOverMemoryTransport(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+	configuration := MemoryConfiguration(Configuration{
+		MaxSendsInFlight:         10,
+		SendQueueMaxCapacity:     1024,
+		HubMaxDatagramSize:       HubDefaultMaxDatagramSize,
+		HubHeartbeatMilliseconds: 20,
+		HubFailoverMilliseconds:  200,
+	})
+	var memory MemoryTransport
+	InitMemoryTransport(&memory)
+	var running sync.WaitGroup
+	defer running.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startMemoryGob(ctx, t, &memory, configuration, &running)
+	startMemoryHub(ctx, t, &memory, configuration, &running)
+
+	// Replies to requests with their payload in upper case, and records the rest
+	const requestType, replyType, noteType uint16 = 1, 2, 3
+	var mutex sync.Mutex
+	var notes []string
+	var responder App
+	InitApp(&responder, 2, configuration)
+	responder.Transport = &memory
+	err := SubscribeApp(&responder, requestType, "request", func(data *AppCommData, decoded interface{}) {
+		reply := EncodeReplyPayload(nil, CorrelationOf(data), bytes.ToUpper(data.Payload))
+		if _, err := SendApp(&responder, replyType, reply); err != nil {
+			t.Error("Could not reply: ", err)
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SubscribeApp(&responder, noteType, "note", func(data *AppCommData, decoded interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		notes = append(notes, string(data.Payload))
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var admin []string
+	err = RegisterSystemMessageType(&responder.Registry, MessageTypeAdmin, "admin", func(data *AppCommData, decoded interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		admin = append(admin, string(data.Payload))
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StartApp(&responder); err != nil {
+		t.Fatal(err)
+	}
+	defer StopApp(&responder)
+
+	var client App
+	InitApp(&client, 1, configuration)
+	client.Transport = &memory
+	var requester Requester
+	if err := InitRequester(&requester, &client, replyType); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartApp(&client); err != nil {
+		t.Fatal(err)
+	}
+	defer StopApp(&client)
+
+	// Requests get their replies over the Hub
+	for i := 0; i < 10; i++ {
+		requestCtx, requestCancel := context.WithTimeout(ctx, 5*time.Second)
+		reply, err := Request(requestCtx, &requester, requestType, []byte(fmt.Sprint("request ", i)))
+		requestCancel()
+		if err != nil {
+			t.Fatal("Request ", i, ": ", err)
+		}
+		if expected := fmt.Sprint("REQUEST ", i); string(reply) != expected {
+			t.Errorf("Reply to request %d is %q, expected %q", i, reply, expected)
+		}
+	}
+	if WaitingRequests(&requester) != 0 {
+		t.Error("Requests still waiting after their replies")
+	}
+
+	// System messages sent from App to App reach the Apps that register them
+	if _, err := SendApp(&client, MessageTypeAdmin, []byte("admin")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SendApp(&client, MessageTypeHubSessionStart, nil); err != ErrMessageTypeReserved {
+		t.Errorf("Sending a Hub session start returned %v, expected %v", err, ErrMessageTypeReserved)
+	}
+	adminCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(admin)
+	}
+	if !waitFor(5*time.Second, func() bool { return adminCount() > 0 }) {
+		t.Fatal("Admin message not delivered")
+	}
+
+	// Every App message arrives once, in order
+	const messages = 100
+	for i := 0; i < messages; i++ {
+		if _, err := SendApp(&client, noteType, []byte(fmt.Sprint("note ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noteCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(notes)
+	}
+	if !waitFor(5*time.Second, func() bool { return noteCount() >= messages && AppSendsPending(&client) == 0 }) {
+		t.Fatalf("Got %d of %d App messages", noteCount(), messages)
+	}
+	mutex.Lock()
+	for i, note := range notes {
+		if expected := fmt.Sprint("note ", i); note != expected {
+			t.Fatalf("App message number %d is %q, expected %q", i, note, expected)
+		}
+	}
+	mutex.Unlock()
+	time.Sleep(100 * time.Millisecond) // Let the Gob hear the last Hub message too
+
+	// An App starting late and catching up gets the history from the Gob, as replayed, before the
+	// live App messages
+	var late App
+	InitApp(&late, 3, configuration)
+	late.Configuration.AppCatchUpOnStart = true
+	late.Transport = &memory
+	var replayed, live []string
+	err = SubscribeApp(&late, noteType, "note", func(data *AppCommData, decoded interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if AppReplaying(&late) {
+			replayed = append(replayed, string(data.Payload))
+		} else {
+			live = append(live, string(data.Payload))
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StartApp(&late); err != nil {
+		t.Fatal(err)
+	}
+	defer StopApp(&late)
+
+	// One starting late without catching up only gets the live App messages
+	var current App
+	InitApp(&current, 4, configuration)
+	current.Transport = &memory
+	var currentNotes []string
+	err = SubscribeApp(&current, noteType, "note", func(data *AppCommData, decoded interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if AppReplaying(&current) {
+			t.Error("App that didn't catch up got a replayed App message: ", string(data.Payload))
+		}
+		currentNotes = append(currentNotes, string(data.Payload))
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StartApp(&current); err != nil {
+		t.Fatal(err)
+	}
+	defer StopApp(&current)
+	for i := messages; i < 2*messages; i++ {
+		if _, err := SendApp(&client, noteType, []byte(fmt.Sprint("note ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lateCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(replayed) + len(live)
+	}
+	currentCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(currentNotes)
+	}
+	if !waitFor(5*time.Second, func() bool { return lateCount() >= 2*messages && currentCount() >= messages }) {
+		t.Fatalf("Late Apps got %d of %d and %d of %d App messages", lateCount(), 2*messages, currentCount(), messages)
+	}
+	time.Sleep(100 * time.Millisecond) // Catch anything more
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(replayed) != messages {
+		t.Errorf("Late App got %d replayed App messages, expected %d", len(replayed), messages)
+	}
+	for i, note := range append(replayed, live...) {
+		if expected := fmt.Sprint("note ", i); note != expected {
+			t.Fatalf("Late App message number %d is %q, expected %q", i, note, expected)
+		}
+	}
+	if len(currentNotes) != messages {
+		t.Errorf("Late App that didn't catch up got %d App messages, expected %d", len(currentNotes), messages)
+	}
+	for i, note := range currentNotes {
+		if expected := fmt.Sprint("note ", messages+i); note != expected {
+			t.Fatalf("Late App that didn't catch up got %q as App message number %d, expected %q", note, i, expected)
+		}
+	}
+}
+
+// TestStopAppWaitsForHub stops Apps with App messages still in flight. They are all accepted if
+// there is a Hub, and counted as dropped if there isn't.
+func TestStopAppWaitsForHub(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+	configuration := MemoryConfiguration(Configuration{
+		MaxSendsInFlight:         10,
+		SendQueueMaxCapacity:     1024,
+		HubMaxDatagramSize:       HubDefaultMaxDatagramSize,
+		HubHeartbeatMilliseconds: 20,
+		HubFailoverMilliseconds:  200,
+	})
+	const messages = 100
+	send := func(memory *MemoryTransport, stopTimeout time.Duration) int {
+		var app App
+		InitApp(&app, 1, configuration)
+		app.Transport = memory
+		app.StopTimeout = stopTimeout
+		if err := StartApp(&app); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < messages; i++ {
+			if _, err := SendApp(&app, 1, []byte(fmt.Sprint("message ", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return StopApp(&app)
+	}
+
+	var withoutHub MemoryTransport
+	InitMemoryTransport(&withoutHub)
+	if dropped := send(&withoutHub, 50*time.Millisecond); dropped != messages {
+		t.Errorf("Dropped %d App messages without a Hub, expected %d", dropped, messages)
+	}
+
+	var withHub MemoryTransport
+	InitMemoryTransport(&withHub)
+	var running sync.WaitGroup
+	defer running.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startMemoryHub(ctx, t, &withHub, configuration, &running)
+	if dropped := send(&withHub, 5*time.Second); dropped != 0 {
+		t.Errorf("Dropped %d App messages with a Hub, expected 0", dropped)
+	}
+}
@@ -8,17 +8,71 @@ our $VERSION = '0.1.0';
 use utf8;
 use JSON;
 
-my $broadcast_address = broadcast_for_interface( default_route_interface() );
+# Run as "./autoconfig.pl multicast" to use an IP multicast group instead of
+# the broadcast address of the interface, or as "./autoconfig.pl ipv6" to use
+# a link-local IPv6 multicast group on the interface, or as
+# "./autoconfig.pl unicast" for a Hub and Gob on this host sending to each
+# registered App, where neither broadcast nor multicast is available.
+my $mode = @ARGV ? $ARGV[0] : 'broadcast';
+my $use_multicast = $mode eq 'multicast' || $mode eq 'ipv6';
+
+my $interface = default_route_interface();
+my $rise_address = broadcast_for_interface($interface);
+my $sink_address = '0.0.0.0';
+my $tcp_address = '0.0.0.0';
+my $app_sink_port = 9999;
+if ( $mode eq 'multicast' ) {
+    $rise_address = $sink_address = '239.255.0.1';
+}
+elsif ( $mode eq 'ipv6' ) {
+    $rise_address = $sink_address = "[ff02::4242%$interface]";
+    $tcp_address  = '[::]';
+}
+elsif ( $mode eq 'unicast' ) {
+    $rise_address  = address_for_interface($interface);
+    $app_sink_port = 0;
+}
 
 my $json_data = {
-    'AppRiseAddress'       => "$broadcast_address:9998",
-    'AppSinkAddress'       => '0.0.0.0:9999',
-    'HubRiseAddress' => "$broadcast_address:9999",
-    'HubSinkAddress' => '0.0.0.0:9998',
-    'GobRiseAddress' => "$broadcast_address:9997",
-    'GobSinkAddress' => '0.0.0.0:9996',
-    'GobTCPAddress' => '0.0.0.0:9996',
+    'AppRiseAddress'       => "$rise_address:9998",
+    'AppSinkAddress'       => "$sink_address:$app_sink_port",
+    'HubRiseAddress' => $mode eq 'unicast' ? q{} : "$rise_address:9999",
+    'HubSinkAddress' => "$sink_address:9998",
+    'GobSinkAddress' => "$sink_address:9996",
+    'GobTCPAddress' => "$tcp_address:9996",
+    'AppGobRiseAddress' => "$rise_address:9996",
+    'GobJournalDirectory' => 'gob_journal',
+    'GobJournalSyncPolicy' => 'interval',
+    'GobJournalSyncMilliseconds' => 1000,
+    'GobJournalSegmentBytes' => 67108864,
+    'GobJournalRetentionSeconds' => 86400,
+    'GobJournalRetentionBytes' => 1073741824,
+    'AppCatchUpOnStart' => JSON::true,
     'MaxSendsInFlight'     => 10,
+    'SendQueueMaxCapacity' => 1024,
+    'HubMaxDatagramSize' => 1472,
+    'HubMaxLingerMicroseconds' => 100,
+    'HubSessionFile' => 'hub_session',
+    'HubCheckpointFile' => 'hub_checkpoint.json',
+    'HubCheckpointMilliseconds' => 1000,
+    'HubRebuildFromGob' => JSON::true,
+    'HubHeartbeatMilliseconds' => 100,
+    'HubFailoverMilliseconds' => 1000,
+    'AppHubTimeoutMilliseconds' => 1000,
+    'AppGapTimeoutMilliseconds' => 10000,
+    'AppStopTimeoutMilliseconds' => 5000,
+    'FaultDropProbability' => 0,
+    'FaultDuplicateProbability' => 0,
+    'FaultReorderProbability' => 0,
+    'FaultDelayProbability' => 0,
+    'FaultMaxDelayMilliseconds' => 20,
+    'FaultTruncateProbability' => 0,
+    'FaultSeed' => 0,
+    'MulticastInterface' => $use_multicast ? $interface : q{},
+    'MulticastTTL' => 1,
+    'MulticastDisableLoopback' => JSON::false,
+    'HubUnicastFanOut' => $mode eq 'unicast' ? JSON::true : JSON::false,
+    'HubRegistrationTimeoutMilliseconds' => 3000,
     
 };
 open my $file_handle, q{>}, 'conf.json';
@@ -56,3 +110,13 @@ sub broadcast_for_interface {
     }
     return q{};
 }
+
+sub address_for_interface {
+    my $interface_to_find = shift;
+    foreach my $line (`ip -4 addr show dev $interface_to_find`) {
+        if ( $line =~ / inet ([\d.]+)/ ) {
+            return $1;
+        }
+    }
+    return q{};
+}
@@ -2,8 +2,8 @@ package main
 
 // The purpose of this program, is to test broadcast output from App to Hub
 import (
+	"log"
 	// "math/rand"
-	"net"
 	"time"
 
 	rwf "github.com/pdxiv/gonetworktest"
@@ -16,27 +16,26 @@ func main() {
 	// Load configuration from file
 	configuration := rwf.GetConfiguration(rwf.ConfigFile)
 
-	destinationAddress, _ := net.ResolveUDPAddr("udp", configuration.AppRiseAddress)
-	connection, _ := net.DialUDP("udp", nil, destinationAddress)
-	defer connection.Close()
-
-	var data rwf.AppCommData
-
-	rwf.InitAppMessage(&data)
-
 	// Set a random dummy application ID
 	//rand.Seed(time.Now().UTC().UnixNano())
-	//data.ID = rand.Uint64()
-	data.ID = 2323
-
-	// ticker := time.NewTicker(100 * time.Millisecond)
-	ticker := time.NewTicker(1000 * time.Nanosecond)
+	//ID := rand.Uint64()
+	var app rwf.App
+	rwf.InitApp(&app, 2323, configuration)
+	if err := rwf.StartApp(&app); err != nil {
+		log.Fatal(err)
+	}
+	defer rwf.StopApp(&app)
 
-	for data.AppSequenceNumber < PacketLimit {
-		select {
-		case <-ticker.C:
-			data.Payload = []byte("Hello")
-			rwf.SendAppMessage(&data, connection)
+	for sent := 0; sent < PacketLimit; {
+		// When too many messages are waiting, wait for the Hub to accept some before sending more
+		if _, err := rwf.SendApp(&app, 0, []byte("Hello")); err != nil {
+			time.Sleep(time.Millisecond)
+			continue
 		}
+		sent++
+	}
+	// Keep going until every message has been accepted by the Hub
+	for rwf.AppSendsPending(&app) > 0 {
+		time.Sleep(10 * time.Millisecond)
 	}
 }
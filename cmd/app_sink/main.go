@@ -2,9 +2,7 @@ package main
 
 // The purpose of this program, is to test broadcast input from Hub to App
 import (
-	"context"
 	"log"
-	"net"
 	"time"
 
 	rwf "github.com/pdxiv/gonetworktest"
@@ -18,51 +16,16 @@ func startSession() {
 	// Load configuration from file
 	configuration := rwf.GetConfiguration(rwf.ConfigFile)
 
-	var lc net.ListenConfig
-	lc = net.ListenConfig{Control: rwf.ControlOnConnSetupSoReusePort}
-	// Listen to incoming UDP datagrams
-	pc, err := lc.ListenPacket(context.Background(), "udp", configuration.AppSinkAddress)
-	defer pc.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Initialize time ticker for keeping track of when events happen
-	ticker := time.NewTicker(time.Nanosecond)
-	defer ticker.Stop()
-	latestTime := time.Now().UnixNano() // Initialize timestamp
-
-	// Initialize channel for receiving
-	appReceiver := make(chan rwf.AppCommData, 1)
-
-	go receiveHubMessageAndDecode(pc, appReceiver)
-	for {
-		select {
-		case t := <-ticker.C:
-			latestTime = t.UnixNano()
-		case messageReceived := <-appReceiver:
-			log.Print("Message: ", string(messageReceived.Payload), " Time: ", latestTime)
-		}
+	// We only listen, so every App message is someone else's
+	var app rwf.App
+	rwf.InitApp(&app, 0, configuration)
+	app.DeliverOwnMessages = true
+	app.Registry.Unhandled = func(data *rwf.AppCommData, decoded interface{}) {
+		log.Print("Message: ", string(data.Payload), " Time: ", time.Now().UnixNano())
 	}
-}
-
-func receiveHubMessageAndDecode(pc net.PacketConn, appReceiver chan rwf.AppCommData) {
-	var hubData rwf.HubCommData
-	rwf.InitHubMessage(&hubData)
-	var appData rwf.AppCommData
-	rwf.InitAppMessage(&appData)
-	hubData.MasterBuffer = hubData.MasterBuffer[0:rwf.BufferAllocationSize] // allocate receive buffer
-
-	for {
-		// Simple read
-		pc.ReadFrom(hubData.MasterBuffer)
-		if rwf.DecodeHubMessage(&hubData) {
-			// Copy the payload of the hub message to the Master Buffer of the app message
-			appData.MasterBuffer = hubData.Payload
-			rwf.AppDecodeAppMessage(&appData)
-			appReceiver <- appData
-			hubData.ExpectedHubSequenceNumber++
-		} else {
-		}
+	if err := rwf.StartApp(&app); err != nil {
+		log.Fatal(err)
 	}
+	defer rwf.StopApp(&app)
+	select {}
 }
@@ -0,0 +1,99 @@
+package main
+
+// Keeps the per-App sequence numbers of the Hub across restarts
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	rwf "github.com/pdxiv/gonetworktest"
+)
+
+// hubCheckpoint is what the Hub saves to HubCheckpointFile
+type hubCheckpoint struct {
+	SessionID              uint64
+	HubSequenceNumber      uint64 // Next Hub sequence number to be sent
+	ExpectedSequenceForApp map[uint64]uint64
+}
+
+// loadHubCheckpoint reads a checkpoint. A missing file gives an empty checkpoint.
+func loadHubCheckpoint(filename string) (hubCheckpoint, error) {
+	checkpoint := hubCheckpoint{ExpectedSequenceForApp: make(map[uint64]uint64)}
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, err
+	}
+	err = json.Unmarshal(contents, &checkpoint)
+	if checkpoint.ExpectedSequenceForApp == nil {
+		checkpoint.ExpectedSequenceForApp = make(map[uint64]uint64)
+	}
+	return checkpoint, err
+}
+
+// saveHubCheckpoint writes a checkpoint to a temporary file and renames it into place, so a crash
+// never leaves a half written checkpoint behind
+func saveHubCheckpoint(filename string, checkpoint hubCheckpoint) error {
+	contents, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	temporaryFile := filename + ".tmp"
+	file, err := os.Create(temporaryFile)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(contents); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile, filename)
+}
+
+// rebuildFromGob fetches the history of the latest session from a Gob, and moves the expected
+// sequence number of every App in it past the last message the Hub sent for it. This catches what
+// happened after the last checkpoint, and what the standby Hub missed, including where the latest
+// session ended.
+func rebuildFromGob(configuration rwf.Configuration, transport rwf.Transport, standby *hubStandby) error {
+	frames := make(chan []byte, 128)
+	fetched := make(chan error, 1)
+	go func() {
+		fetched <- rwf.CatchUpFromGob(transport, configuration, frames, nil)
+		close(frames)
+	}()
+
+	var hubData rwf.HubCommData
+	rwf.InitHubMessage(&hubData)
+	var appData rwf.AppCommData
+	rwf.InitAppMessage(&appData)
+	var appMessages rwf.AppMessageIterator
+	hubMessages := 0
+	for frame := range frames {
+		hubData.MasterBuffer = frame
+		if rwf.DecodeHubHeader(&hubData) != nil {
+			continue
+		}
+		hubMessages++
+		if hubData.SessionID > standby.primarySessionID {
+			standby.primarySessionID = hubData.SessionID
+			standby.nextHubSequenceNumber = 0
+		}
+		if hubData.SessionID == standby.primarySessionID && hubData.HubSequenceNumber >= standby.nextHubSequenceNumber {
+			standby.nextHubSequenceNumber = hubData.HubSequenceNumber + 1
+		}
+		rwf.InitAppMessageIterator(&appMessages, &hubData)
+		for rwf.NextAppMessage(&appMessages, &appData) {
+			rwf.UpdateExpectedAppSequence(standby.expectedSequenceForApp, &appData)
+		}
+	}
+	log.Print("Rebuilt App sequence numbers from ", hubMessages, " Hub messages from Gob")
+	return <-fetched
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	rwf "github.com/pdxiv/gonetworktest"
+)
+
+// startFailoverHub runs a Hub as cmd/hub does, standing by until no other Hub is heard from
+func startFailoverHub(ctx context.Context, memory *rwf.MemoryTransport, configuration rwf.Configuration, done *sync.WaitGroup) error {
+	hubPC, err := memory.ListenPacket(configuration.AppSinkAddress)
+	if err != nil {
+		return err
+	}
+	frames := make(chan []byte, 128)
+	go rwf.ReceiveHubFrames(hubPC, frames, ctx.Done())
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		defer hubPC.Close()
+		runHub(ctx, frames, configuration, memory)
+	}()
+	return nil
+}
+
+// waitForHubMessage waits until a Hub message is heard, so that a Hub is known to be primary
+func waitForHubMessage(t *testing.T, transport rwf.Transport, configuration rwf.Configuration) {
+	pc, err := transport.ListenPacket(configuration.AppSinkAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, rwf.BufferAllocationSize)
+	if _, _, err := pc.ReadFrom(buffer); err != nil {
+		t.Fatal("No Hub became primary: ", err)
+	}
+}
+
+// TestFailover runs a Gob and two Hubs over a MemoryTransport, and stops the primary Hub while an
+// App is sending
+func TestFailover(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+	configuration := rwf.MemoryConfiguration(rwf.Configuration{
+		MaxSendsInFlight:         10,
+		SendQueueMaxCapacity:     1024,
+		HubMaxDatagramSize:       rwf.HubDefaultMaxDatagramSize,
+		HubHeartbeatMilliseconds: 20,
+		HubFailoverMilliseconds:  200,
+	})
+	var memory rwf.MemoryTransport
+	rwf.InitMemoryTransport(&memory)
+	var running sync.WaitGroup
+	defer running.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var gob rwf.Gob
+	rwf.InitGob(&gob, configuration)
+	gob.Transport = &memory
+	gob.Logger = log.New(io.Discard, "", 0)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		if err := rwf.RunGob(ctx, &gob); err != nil {
+			t.Error("Gob failed: ", err)
+		}
+	}()
+	if err := rwf.WaitForGob(&memory, configuration, 5*time.Second); err != nil {
+		t.Fatal("Gob didn't start listening: ", err)
+	}
+
+	primaryCtx, stopPrimary := context.WithCancel(ctx)
+	defer stopPrimary()
+	if err := startFailoverHub(primaryCtx, &memory, configuration, &running); err != nil {
+		t.Fatal(err)
+	}
+	waitForHubMessage(t, &memory, configuration)
+	if err := startFailoverHub(ctx, &memory, configuration, &running); err != nil {
+		t.Fatal(err)
+	}
+
+	// The receiving App loses some datagrams, so that it has to get some of each session from the Gob
+	faultConfiguration := configuration
+	faultConfiguration.FaultDropProbability = 0.05
+	faultConfiguration.FaultSeed = 1
+	var faults rwf.FaultTransport
+	rwf.InitFaultTransport(&faults, &memory, faultConfiguration)
+	sendThroughFailover(t, configuration, &memory, &faults, stopPrimary)
+}
+
+// sendThroughFailover has one App send App messages while another App records them, stops the
+// primary Hub a third of the way through, and checks that the receiving App gets every App message
+// exactly once, in order, from the primary Hub and then from the standby Hub
+func sendThroughFailover(t *testing.T, configuration rwf.Configuration, senderTransport rwf.Transport, receiverTransport rwf.Transport, stopPrimary func()) {
+	var mutex sync.Mutex
+	var received []string
+	sessionChanges := 0
+	var receiver rwf.App
+	rwf.InitApp(&receiver, 2, configuration)
+	receiver.Transport = receiverTransport
+	receiver.Registry.Unhandled = func(data *rwf.AppCommData, decoded interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, string(data.Payload))
+	}
+	receiver.HubData.SessionChanged = func(oldSessionID uint64, newSessionID uint64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sessionChanges++
+	}
+	heard := make(chan bool, 1)
+	receiver.HubData.LivenessChanged = func(alive bool) {
+		select {
+		case heard <- alive:
+		default:
+		}
+	}
+	if err := rwf.StartApp(&receiver); err != nil {
+		t.Fatal(err)
+	}
+	defer rwf.StopApp(&receiver)
+	// The receiver starts from the first Hub message it hears, so nothing is sent before that
+	select {
+	case <-heard:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The receiving App didn't hear the Hub")
+	}
+	var sender rwf.App
+	rwf.InitApp(&sender, 1, configuration)
+	sender.Transport = senderTransport
+	if err := rwf.StartApp(&sender); err != nil {
+		t.Fatal(err)
+	}
+	defer rwf.StopApp(&sender)
+	count := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(received)
+	}
+
+	// Stop the primary Hub a third of the way through
+	const messages = 300
+	for i := 0; i < messages; i++ {
+		if _, err := rwf.SendApp(&sender, 1, []byte(fmt.Sprint("message ", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == messages/3 {
+			for count() < messages/3 {
+				time.Sleep(time.Millisecond)
+			}
+			stopPrimary()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	for count() < messages && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) // Catch duplicates
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if sessionChanges != 2 {
+		t.Errorf("Got %d session changes, expected 2", sessionChanges)
+	}
+	if len(received) != messages {
+		t.Errorf("Got %d App messages, expected %d", len(received), messages)
+	}
+	for i, payload := range received {
+		if expected := fmt.Sprint("message ", i); payload != expected {
+			t.Fatalf("App message number %d is %q, expected %q", i, payload, expected)
+		}
+	}
+}
+
+// TestFailoverProcesses builds cmd/gob and cmd/hub, runs a Gob and two Hubs as processes talking
+// over loopback broadcast, and kills the primary Hub while an App is sending
+func TestFailoverProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Builds and runs the Gob and the Hub")
+	}
+	goCommand, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No go command to build with")
+	}
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+	directory := t.TempDir()
+	binaries := t.TempDir()
+	for _, command := range []string{"gob", "hub"} {
+		build := exec.Command(goCommand, "build", "-o", filepath.Join(binaries, command), "../"+command)
+		if message, err := build.CombinedOutput(); err != nil {
+			t.Fatalf("Could not build %s: %v\n%s", command, err, message)
+		}
+	}
+
+	// Every process reads conf.json where it runs, and the Hubs keep their own session and checkpoint files
+	hubSink, hubRise, gobSink := freeLoopbackPort(t), freeLoopbackPort(t), freeLoopbackPort(t)
+	configuration := rwf.Configuration{
+		HubSinkAddress:            ":" + hubSink,
+		HubRiseAddress:            "127.255.255.255:" + hubRise,
+		AppSinkAddress:            ":" + hubRise,
+		AppRiseAddress:            "127.255.255.255:" + hubSink,
+		GobSinkAddress:            ":" + gobSink,
+		GobTCPAddress:             ":" + gobSink,
+		AppGobRiseAddress:         "127.255.255.255:" + gobSink,
+		MaxSendsInFlight:          10,
+		SendQueueMaxCapacity:      1024,
+		HubMaxDatagramSize:        rwf.HubDefaultMaxDatagramSize,
+		HubSessionFile:            "hub_session",
+		HubCheckpointFile:         "hub_checkpoint.json",
+		HubCheckpointMilliseconds: 100,
+		HubRebuildFromGob:         true,
+		HubHeartbeatMilliseconds:  20,
+		HubFailoverMilliseconds:   300,
+	}
+	encoded, err := json.Marshal(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func(command string, name string) *exec.Cmd {
+		working := filepath.Join(directory, name)
+		if err := os.Mkdir(working, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(working, rwf.ConfigFile), encoded, 0644); err != nil {
+			t.Fatal(err)
+		}
+		process := exec.Command(filepath.Join(binaries, command))
+		process.Dir = working
+		var logged bytes.Buffer
+		process.Stderr = &logged
+		if err := process.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			process.Process.Kill()
+			process.Wait()
+			if t.Failed() {
+				t.Logf("%s logged:\n%s", name, logged.String())
+			}
+		})
+		return process
+	}
+
+	transport := rwf.ConfiguredTransport(configuration)
+	start("gob", "gob")
+	if err := rwf.WaitForGob(transport, configuration, 10*time.Second); err != nil {
+		t.Fatal("Gob didn't start listening: ", err)
+	}
+	primary := start("hub", "primary")
+	waitForHubMessage(t, transport, configuration)
+	start("hub", "standby")
+	sendThroughFailover(t, configuration, transport, transport, func() {
+		if err := primary.Process.Kill(); err != nil {
+			t.Error("Could not kill the primary Hub: ", err)
+		}
+	})
+}
+
+// freeLoopbackPort finds a port that is free for both UDP and TCP
+func freeLoopbackPort(t *testing.T) string {
+	for {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+		listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+		pc.Close()
+		if err == nil {
+			listener.Close()
+			return strconv.Itoa(port)
+		}
+	}
+}
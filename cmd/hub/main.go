@@ -5,6 +5,10 @@ import (
 	"context"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	rwf "github.com/pdxiv/gonetworktest"
 )
@@ -16,38 +20,125 @@ func main() {
 func startSession() {
 	// Load configuration from file
 	configuration := rwf.GetConfiguration(rwf.ConfigFile)
+	if err := rwf.ValidateConfiguration(configuration); err != nil {
+		log.Fatal(err)
+	}
 
-	destinationAddress, _ := net.ResolveUDPAddr("udp", configuration.HubRiseAddress)
-	connection, _ := net.DialUDP("udp", nil, destinationAddress)
-	defer connection.Close()
+	// Stop gracefully on Ctrl-C, or when asked to terminate
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	var lc net.ListenConfig
-	lc = net.ListenConfig{Control: rwf.ControlOnConnSetupSoReusePort}
-	// Listen to incoming UDP datagrams
-	pc, err := lc.ListenPacket(context.Background(), "udp", configuration.HubSinkAddress)
+	// Listen to Hub messages, to hear from other Hubs
+	transport := rwf.ConfiguredTransport(configuration)
+	hubPC, err := transport.ListenPacket(configuration.AppSinkAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer pc.Close()
-	listenToAppAndSendHub(pc, connection)
+	defer hubPC.Close()
+	frames := make(chan []byte, 128)
+	go rwf.ReceiveHubFrames(hubPC, frames, ctx.Done())
+	if configuration.HubUnicastFanOut {
+		go keepRegistered(ctx, hubPC, configuration)
+	}
+	runHub(ctx, frames, configuration, transport)
 }
 
-func listenToAppAndSendHub(pc net.PacketConn, connection *net.UDPConn) {
+// runHub starts as a standby Hub, and becomes the primary Hub when no other Hub is heard from. If a
+// Hub with a higher session is heard from while primary, it goes back to standing by. frames are
+// the Hub messages heard, and the Hub and the Gob are reached over the transport.
+func runHub(ctx context.Context, frames chan []byte, configuration rwf.Configuration, transport rwf.Transport) {
+	// To keep track of the expected sequence number for each app, restored from the last checkpoint
+	checkpoint, err := loadHubCheckpoint(configuration.HubCheckpointFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if checkpoint.SessionID != 0 {
+		log.Print("Previous session ", checkpoint.SessionID, " was checkpointed at Hub sequence number ", checkpoint.HubSequenceNumber, ", with ", len(checkpoint.ExpectedSequenceForApp), " Apps")
+	}
+	var standby hubStandby
+	initHubStandby(&standby, checkpoint.ExpectedSequenceForApp)
+
+	for waitAsStandby(ctx, &standby, frames, configuration) {
+		// Anything accepted by the previous Hub, and not mirrored or checkpointed, can be found in the Gob
+		if configuration.HubRebuildFromGob {
+			if err := rebuildFromGob(configuration, transport, &standby); err != nil {
+				log.Print("Could not rebuild from Gob: ", err)
+			}
+		} else if standby.missedHubMessages {
+			log.Print("Some Hub messages from the primary Hub were missed, so Apps may be sequenced twice")
+		}
+		standby.missedHubMessages = false
+
+		var hub rwf.Hub
+		rwf.InitHub(&hub, configuration)
+		hub.Transport = transport
+		hub.Logger = log.Default()
+		hub.SessionID, err = rwf.NewSessionID(configuration.HubSessionFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The clock of the previous Hub may have been ahead of ours
+		if hub.SessionID <= standby.primarySessionID {
+			hub.SessionID = standby.primarySessionID + 1
+		}
+		// Tell the Apps where the previous session ended, so they can fetch what they missed of it
+		hub.PreviousSessionID = checkpoint.SessionID
+		hub.PreviousHubSequenceNumber = checkpoint.HubSequenceNumber
+		if standby.primarySessionID > hub.PreviousSessionID || (standby.primarySessionID == hub.PreviousSessionID && standby.nextHubSequenceNumber > hub.PreviousHubSequenceNumber) {
+			hub.PreviousSessionID = standby.primarySessionID
+			hub.PreviousHubSequenceNumber = standby.nextHubSequenceNumber
+		}
+		// Work on a copy, so the mirror is as it was if we have to step down
+		for ID, sequence := range standby.expectedSequenceForApp {
+			hub.ExpectedSequenceForApp[ID] = sequence
+		}
 
-	// To keep track of the expected sequence number for each app
-	expectedSequenceForApp := make(map[uint64]uint64)
+		// Run until stopped, or until a Hub with a higher session is heard from
+		primaryCtx, stepDown := context.WithCancel(ctx)
+		higherSessionID := make(chan uint64, 1)
+		go watchForHigherSession(primaryCtx, stepDown, frames, hub.SessionID, higherSessionID)
+		if configuration.HubCheckpointFile != "" {
+			hub.Checkpoint = func(sessionID uint64, hubSequenceNumber uint64, expectedSequenceForApp map[uint64]uint64) error {
+				// A Hub that steps down has sent its last Hub messages in vain
+				if ctx.Err() == nil && primaryCtx.Err() != nil {
+					return nil
+				}
+				return saveHubCheckpoint(configuration.HubCheckpointFile, hubCheckpoint{
+					SessionID:              sessionID,
+					HubSequenceNumber:      hubSequenceNumber,
+					ExpectedSequenceForApp: expectedSequenceForApp,
+				})
+			}
+		}
+		err := rwf.RunHub(primaryCtx, &hub)
+		stepDown()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		standby.primarySessionID = <-higherSessionID
+		standby.nextHubSequenceNumber = 0
+		log.Print("Stepping down for Hub session ", standby.primarySessionID)
+	}
+}
 
-	var hubData rwf.HubCommData
-	rwf.InitHubMessage(&hubData)
-	var sinkData rwf.AppCommData
-	rwf.InitAppMessage(&sinkData)
-	sinkData.MasterBuffer = sinkData.MasterBuffer[0:rwf.BufferAllocationSize] // Allocate receive buffer
+// keepRegistered registers with the Hub doing unicast fan-out, so that a standby Hub hears the
+// primary Hub, and a primary Hub hears any Hub with a higher session
+func keepRegistered(ctx context.Context, hubPC net.PacketConn, configuration rwf.Configuration) {
+	hubAddress, err := net.ResolveUDPAddr("udp", configuration.AppRiseAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registrationTicker := time.NewTicker(rwf.HubRegistrationInterval(configuration))
+	defer registrationTicker.Stop()
 	for {
-		// Simple read
-		pc.ReadFrom(sinkData.MasterBuffer)
-		// Only send a Hub message if App message is valid
-		if rwf.HubDecodeAppMessage(&sinkData, &expectedSequenceForApp) {
-			rwf.SendHubMessage(&sinkData, &hubData, connection)
+		rwf.SendHubRegistration(hubPC, hubAddress, 0)
+		select {
+		case <-ctx.Done():
+			return
+		case <-registrationTicker.C:
 		}
 	}
 }
@@ -0,0 +1,125 @@
+package main
+
+// Hot standby. A Hub listens to the Hub broadcasts of the primary Hub, and takes over when it goes quiet.
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	rwf "github.com/pdxiv/gonetworktest"
+)
+
+// defaultFailoverMilliseconds is how long a standby Hub waits for the primary Hub, if not configured
+const defaultFailoverMilliseconds = 1000
+
+// hubStandby is what a standby Hub knows about the primary Hub, mirrored from its Hub messages
+type hubStandby struct {
+	expectedSequenceForApp map[uint64]uint64
+	primarySessionID       uint64 // Highest session heard from. Lower ones are left over from earlier Hubs.
+	nextHubSequenceNumber  uint64
+	missedHubMessages      bool // Hub messages from the primary were missed, so the mirror may be behind
+	lastHeard              time.Time
+	// Buffers for decoding mirrored Hub messages
+	hubData     rwf.HubCommData
+	appData     rwf.AppCommData
+	appMessages rwf.AppMessageIterator
+}
+
+func initHubStandby(standby *hubStandby, expectedSequenceForApp map[uint64]uint64) {
+	standby.expectedSequenceForApp = expectedSequenceForApp
+	standby.primarySessionID = 0
+	standby.nextHubSequenceNumber = 0
+	standby.missedHubMessages = false
+	standby.lastHeard = time.Now()
+	rwf.InitHubMessage(&standby.hubData)
+	rwf.InitAppMessage(&standby.appData)
+}
+
+// waitAsStandby mirrors the Hub messages of the primary Hub, until there has been no Hub message or
+// heartbeat from it for the failover time. A random extra wait makes it unlikely that two standby
+// Hubs take over at the same time. If they do anyway, the one with the lower session steps down.
+// Returns false if the context is done first.
+func waitAsStandby(ctx context.Context, standby *hubStandby, frames chan []byte, configuration rwf.Configuration) bool {
+	failover := time.Duration(configuration.HubFailoverMilliseconds) * time.Millisecond
+	if failover <= 0 {
+		failover = defaultFailoverMilliseconds * time.Millisecond
+	}
+	silence := failover + time.Duration(rand.Int63n(int64(failover/2)+1))
+	standby.lastHeard = time.Now()
+	checkTicker := time.NewTicker(failover / 10)
+	defer checkTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case frame := <-frames:
+			if mirrorHubMessage(standby, frame) {
+				standby.lastHeard = time.Now()
+			}
+		case <-checkTicker.C:
+			if time.Since(standby.lastHeard) >= silence {
+				if standby.primarySessionID != 0 {
+					log.Print("Nothing heard from primary Hub session ", standby.primarySessionID, " for ", time.Since(standby.lastHeard), " after Hub sequence number ", standby.nextHubSequenceNumber)
+				}
+				return true
+			}
+		}
+	}
+}
+
+// mirrorHubMessage updates the expected sequence number of every App in a Hub message from the
+// primary Hub. Returns false if the Hub message wasn't from the primary.
+func mirrorHubMessage(standby *hubStandby, frame []byte) bool {
+	hubData := &standby.hubData
+	hubData.MasterBuffer = frame
+	if rwf.DecodeHubHeader(hubData) != nil || hubData.SessionID < standby.primarySessionID {
+		return false
+	}
+	if hubData.SessionID > standby.primarySessionID {
+		log.Print("Standing by for primary Hub session ", hubData.SessionID)
+		standby.primarySessionID = hubData.SessionID
+		standby.nextHubSequenceNumber = 0
+	}
+	if hubData.HubSequenceNumber > standby.nextHubSequenceNumber {
+		standby.missedHubMessages = true
+	}
+	if rwf.IsHubHeartbeat(hubData) {
+		// A heartbeat has the next Hub sequence number, which the last one from a stopping Hub tells
+		// the next Hub about
+		if hubData.HubSequenceNumber > standby.nextHubSequenceNumber {
+			standby.nextHubSequenceNumber = hubData.HubSequenceNumber
+		}
+		return true
+	}
+	if hubData.HubSequenceNumber >= standby.nextHubSequenceNumber {
+		standby.nextHubSequenceNumber = hubData.HubSequenceNumber + 1
+	}
+	rwf.InitAppMessageIterator(&standby.appMessages, hubData)
+	for rwf.NextAppMessage(&standby.appMessages, &standby.appData) {
+		rwf.UpdateExpectedAppSequence(standby.expectedSequenceForApp, &standby.appData)
+	}
+	return true
+}
+
+// watchForHigherSession looks through the Hub messages heard while we are the primary Hub, for one
+// from a Hub with a higher session than ours, and steps down if there is one. Our own Hub messages,
+// and those of earlier Hubs, are ignored.
+func watchForHigherSession(ctx context.Context, stepDown context.CancelFunc, frames chan []byte, sessionID uint64, higherSessionID chan uint64) {
+	var hubData rwf.HubCommData
+	rwf.InitHubMessage(&hubData)
+	for {
+		select {
+		case <-ctx.Done():
+			higherSessionID <- 0
+			return
+		case frame := <-frames:
+			hubData.MasterBuffer = frame
+			if rwf.DecodeHubHeader(&hubData) == nil && hubData.SessionID > sessionID {
+				higherSessionID <- hubData.SessionID
+				stepDown()
+				return
+			}
+		}
+	}
+}
@@ -29,12 +29,24 @@ func startSession() {
 }
 
 func receiveAppMessage(pc net.PacketConn) {
+	// To keep track of the expected sequence number for each app
+	expectedSequenceForApp := make(map[uint64]uint64)
+
 	var data rwf.AppCommData
 	rwf.InitAppMessage(&data)
-	data.MasterBuffer = data.MasterBuffer[0:rwf.BufferAllocationSize] // allocate receive buffer
+	receiveBuffer := data.MasterBuffer[0:rwf.BufferAllocationSize] // allocate receive buffer
 	for {
 		// Simple read
-		pc.ReadFrom(data.MasterBuffer)
-		rwf.HubDecodeAppMessage(&data)
+		frameSize, _, err := pc.ReadFrom(receiveBuffer)
+		if err != nil {
+			continue
+		}
+		data.MasterBuffer = receiveBuffer[0:frameSize]
+		accepted, err := rwf.HubDecodeAppMessage(&data, &expectedSequenceForApp)
+		if err != nil {
+			log.Print("Rejected App message: ", err)
+		} else if accepted {
+			log.Print("App message from App ", data.ID, " App sequence number ", data.AppSequenceNumber, " type ", data.Type)
+		}
 	}
 }
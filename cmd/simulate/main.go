@@ -0,0 +1,54 @@
+package main
+
+// Runs a Hub, a Gob and a number of Apps together in one program, over an in-memory transport that
+// injects faults, and checks that every App receives the same App messages in the same order, with
+// no gaps or duplicates. Exits with status 1 if not.
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	rwf "github.com/pdxiv/gonetworktest"
+)
+
+func main() {
+	var configuration rwf.Configuration
+	var simulation rwf.Simulation
+	rwf.InitSimulation(&simulation, configuration)
+	flag.IntVar(&simulation.Apps, "apps", simulation.Apps, "number of Apps, all of them receiving")
+	flag.IntVar(&simulation.Senders, "senders", simulation.Senders, "number of the Apps that also send")
+	flag.IntVar(&simulation.Late, "late", simulation.Late, "number of the Apps that start a third of the way through, and catch up from the Gob")
+	flag.IntVar(&simulation.Messages, "messages", simulation.Messages, "App messages sent by each sending App")
+	flag.BoolVar(&simulation.RestartHub, "restarthub", false, "restart the Hub half way through")
+	flag.BoolVar(&simulation.RestartApp, "restartapp", false, "restart the last sending App half way through its App messages")
+	flag.Float64Var(&configuration.FaultDropProbability, "drop", 0.02, "probability of a datagram being dropped")
+	flag.Float64Var(&configuration.FaultDuplicateProbability, "duplicate", 0.02, "probability of a datagram being duplicated")
+	flag.Float64Var(&configuration.FaultReorderProbability, "reorder", 0.02, "probability of a datagram being reordered")
+	flag.Float64Var(&configuration.FaultDelayProbability, "delay", 0.02, "probability of a datagram being delayed")
+	flag.Float64Var(&configuration.FaultTruncateProbability, "truncate", 0.01, "probability of a datagram being truncated")
+	flag.IntVar(&configuration.FaultMaxDelayMilliseconds, "maxdelay", 20, "longest delay of a datagram, in milliseconds")
+	flag.Int64Var(&configuration.FaultSeed, "seed", 1, "seed for the faults, or 0 for a random one")
+	flag.DurationVar(&simulation.Timeout, "timeout", simulation.Timeout, "how long to wait for every App to get every App message")
+	flag.BoolVar(&configuration.HubUnicastFanOut, "unicast", false, "have the Hub send to each registered App, instead of broadcasting")
+	verbose := flag.Bool("verbose", false, "show what the Hub, the Gob and the Apps log")
+	flag.Parse()
+	simulation.Configuration = configuration
+
+	// What the Hub, the Gob and the Apps log is mostly noise here
+	if *verbose {
+		simulation.ServiceLogger = log.New(os.Stderr, "", log.LstdFlags)
+	} else {
+		log.SetOutput(io.Discard)
+	}
+	problems, err := rwf.RunSimulation(&simulation)
+	if err != nil {
+		simulation.Logger.Fatal(err)
+	}
+	for _, problem := range problems {
+		simulation.Logger.Print(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
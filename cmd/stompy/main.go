@@ -2,9 +2,8 @@ package main
 
 // The purpose of this program, is to have an App listen to Hub and respond
 import (
-	"context"
+	"bytes"
 	"log"
-	"net"
 	"time"
 
 	rwf "github.com/pdxiv/gonetworktest"
@@ -18,54 +17,54 @@ func startSession() {
 	// Load configuration from file
 	configuration := rwf.GetConfiguration(rwf.ConfigFile)
 
-	appState := rwf.InitAppState(4646)
-	log.Print("Send queue has the capacity of this number of entries: ", len(appState.SendQueue))
+	var app rwf.App
+	rwf.InitApp(&app, 4646, configuration)
+	log.Print("Send queue has the capacity of this number of entries: ", len(app.State.SendQueue.Entries))
 
-	var lc net.ListenConfig
-	lc = net.ListenConfig{Control: rwf.ControlOnConnSetupSoReusePort}
-	// Listen to incoming UDP datagrams
-	pc, err := lc.ListenPacket(context.Background(), "udp", configuration.AppSinkAddress)
-	defer pc.Close()
+	// Only the message types we know about are handled
+	err := rwf.SubscribeApp(&app, helloMessageType, "hello", func(data *rwf.AppCommData, decoded interface{}) {
+		log.Print("Message: ", decoded.(string), " Time: ", time.Now().UnixNano())
+	}, decodeHelloMessage)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// Initialize time ticker for keeping track of when events happen
-	ticker := time.NewTicker(time.Nanosecond)
-	defer ticker.Stop()
-	latestTime := time.Now().UnixNano() // Initialize timestamp
-
-	// Initialize channel for receiving
-	appReceiver := make(chan rwf.AppCommData, 1)
-
-	go receiveHubMessageAndDecode(pc, appReceiver)
-	for {
-		select {
-		case t := <-ticker.C:
-			latestTime = t.UnixNano()
-		case messageReceived := <-appReceiver:
-			log.Print("Message: ", string(messageReceived.Payload), " Time: ", latestTime)
+	err = rwf.SubscribeApp(&app, shoutRequestType, "shout request", func(data *rwf.AppCommData, decoded interface{}) {
+		// Requests from before we started have been answered already, or are too old to answer
+		if rwf.AppReplaying(&app) {
+			return
+		}
+		reply := rwf.EncodeReplyPayload(nil, rwf.CorrelationOf(data), bytes.ToUpper(data.Payload))
+		if _, err := rwf.SendApp(&app, shoutReplyType, reply); err != nil {
+			log.Print("Could not reply to request ", data.AppSequenceNumber, " from App ", data.ID, ": ", err)
 		}
+	}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	unhandledMessages := 0
+	app.Registry.Unhandled = func(data *rwf.AppCommData, decoded interface{}) {
+		unhandledMessages++
+		log.Print("Ignored message number ", unhandledMessages, " of unknown type ", data.Type, " from App ", data.ID)
 	}
+
+	if err := rwf.StartApp(&app); err != nil {
+		log.Fatal(err)
+	}
+	defer rwf.StopApp(&app)
+	select {}
 }
 
-func receiveHubMessageAndDecode(pc net.PacketConn, appReceiver chan rwf.AppCommData) {
-	var hubData rwf.HubCommData
-	rwf.InitHubMessage(&hubData)
-	var appData rwf.AppCommData
-	rwf.InitAppMessage(&appData)
-	hubData.MasterBuffer = hubData.MasterBuffer[0:rwf.BufferAllocationSize] // allocate receive buffer
+// Message types of the shout service. Apps send shout requests, and Stompy replies with the
+// payload of the request in upper case, after the correlation of the request.
+const (
+	shoutRequestType uint16 = 1
+	shoutReplyType   uint16 = 2
+)
 
-	for {
-		// Simple read
-		pc.ReadFrom(hubData.MasterBuffer)
-		if rwf.DecodeHubMessage(&hubData) {
-			// Copy the payload of the hub message to the Master Buffer of the app message
-			appData.MasterBuffer = hubData.Payload
-			rwf.AppDecodeAppMessage(&appData)
-			appReceiver <- appData
-			hubData.ExpectedHubSequenceNumber++
-		} else {
-		}
-	}
+// helloMessageType is the type of the greetings sent by app_rise
+const helloMessageType uint16 = 0
+
+// decodeHelloMessage turns the payload of a greeting into a string
+func decodeHelloMessage(payload []byte) (interface{}, error) {
+	return string(payload), nil
 }
@@ -0,0 +1,67 @@
+package main
+
+// The purpose of this program, is to send requests to Stompy, and wait for its replies over the Hub
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	rwf "github.com/pdxiv/gonetworktest"
+)
+
+// RequestLimit is the number of requests sent to Stompy
+const RequestLimit = 100
+
+// Message types of the shout service. Must match cmd/stompy.
+const (
+	shoutRequestType uint16 = 1
+	shoutReplyType   uint16 = 2
+)
+
+// requestInterval is the time between requests
+const requestInterval = 10 * time.Millisecond
+
+// replyTimeout is how long to wait for each reply
+const replyTimeout = 2 * time.Second
+
+func main() {
+	// Load configuration from file
+	configuration := rwf.GetConfiguration(rwf.ConfigFile)
+
+	// Requests are sent, and replies received, by a single App
+	var app rwf.App
+	rwf.InitApp(&app, 4747, configuration)
+	var requester rwf.Requester
+	if err := rwf.InitRequester(&requester, &app, shoutReplyType); err != nil {
+		log.Fatal(err)
+	}
+	if err := rwf.StartApp(&app); err != nil {
+		log.Fatal(err)
+	}
+	defer rwf.StopApp(&app)
+
+	// Each request waits for its reply in a goroutine of its own
+	var requests sync.WaitGroup
+	for i := 0; i < RequestLimit; i++ {
+		requests.Add(1)
+		go shout(&requester, fmt.Sprint("hello number ", i), &requests)
+		time.Sleep(requestInterval)
+	}
+	requests.Wait()
+}
+
+// shout sends a shout request to Stompy, and logs the reply
+func shout(requester *rwf.Requester, text string, requests *sync.WaitGroup) {
+	defer requests.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	sent := time.Now()
+	reply, err := rwf.Request(ctx, requester, shoutRequestType, []byte(text))
+	if err != nil {
+		log.Print("No reply to ", text, ": ", err)
+		return
+	}
+	log.Print("Reply to ", text, ": ", string(reply), " after ", time.Since(sent))
+}
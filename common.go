@@ -2,12 +2,19 @@ package gonetworktest
 
 // Commonly used functions
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // ConfigFile contains the name of the JSON file containing config för the application
@@ -16,20 +23,140 @@ const ConfigFile = "conf.json"
 // BufferAllocationSize sets the amount of space we-pre-allocate for sending and receiving network data
 const BufferAllocationSize = 65507
 
+// AppHeaderSize is the size in bytes of the App message fields in front of the payload
+const AppHeaderSize = 20
+
+// HubHeaderSize is the size in bytes of the Hub message fields in front of the App messages
+const HubHeaderSize = 18
+
+// MaxAppPayloadSize is the longest payload that fits in a Hub message on its own
+const MaxAppPayloadSize = BufferAllocationSize - HubHeaderSize - AppHeaderSize
+
+// HubDefaultMaxDatagramSize is the largest Hub message the Hub puts together, if not configured.
+// Fits in a single Ethernet frame.
+const HubDefaultMaxDatagramSize = 1472
+
 // SendQueueSizeInitialSize denotes the initial size of the send queue
 const SendQueueSizeInitialSize = 16
 
+// GapRequestTimeout is how long to wait for missing Hub messages from a Gob, before asking again
+const GapRequestTimeout = 200 * time.Millisecond
+
+// AppRetransmitTimeout is how long an App waits to see its own message on the Hub, before sending it again
+const AppRetransmitTimeout = 100 * time.Millisecond
+
+// ErrTooManySendsInFlight is returned when an App already has MaxSendsInFlight un-acknowledged messages
+var ErrTooManySendsInFlight = errors.New("too many un-acknowledged App messages in flight")
+
+// ErrAcknowledgeMismatch is returned when the Hub has sequenced an App message with our ID and the
+// App sequence number of a queued message, but not the message that was queued. Something else is
+// sending with our ID, and the queued message is not acknowledged.
+var ErrAcknowledgeMismatch = errors.New("App message from the Hub is not the one queued with its App sequence number")
+
+// HubDefaultHeartbeatMilliseconds is how often an idle Hub sends a heartbeat, if not configured
+const HubDefaultHeartbeatMilliseconds = 100
+
+// HubDefaultTimeout is how long an App waits without hearing from the Hub, before it counts the Hub
+// as dead, if not configured
+const HubDefaultTimeout = time.Second
+
+// MaxPendingHubMessages limits how many out of order Hub messages we keep while waiting for a gap to be filled
+const MaxPendingHubMessages = 65536
+
+// GapDefaultTimeout is how long a gap may go without any of it being filled, before the missing Hub
+// messages are given up on, if not configured
+const GapDefaultTimeout = 10 * time.Second
+
+// AppStopDefaultTimeout is how long StopApp waits for the Hub to accept the App messages already
+// sent, if not configured
+const AppStopDefaultTimeout = 5 * time.Second
+
+// HubSessionChangeTimeout is how long an App tries to get the rest of a Hub session, after Hub
+// messages of a newer session have started arriving, before it gives up and goes on with the newer one
+const HubSessionChangeTimeout = 5 * time.Second
+
+// SessionAnnouncementSize is the size of the payload of a MessageTypeHubSessionStart App message:
+// the previous session ID, and the Hub sequence number it ended at
+const SessionAnnouncementSize = 16
+
 // Configuration is for handling configuration parameters
 type Configuration struct {
 	HubSinkAddress string
 	HubRiseAddress string
 	AppSinkAddress string
 	AppRiseAddress string
-	GobRiseAddress string
 	GobSinkAddress string
 	GobTCPAddress  string
+	// AppGobRiseAddress is where Apps send their requests to a Gob. The Gob answers each App
+	// directly, so there is no GobRiseAddress any more; it is ignored in old configuration files.
+	AppGobRiseAddress string
+	// GobJournalDirectory is where a Gob keeps its journal of Hub messages. No journal if empty.
+	GobJournalDirectory string
+	// GobJournalSyncPolicy is "always", "interval" or "never", for when the journal is synced to disk
+	GobJournalSyncPolicy       string
+	GobJournalSyncMilliseconds int
+	// GobJournalSegmentBytes is the size at which a new journal segment file is started
+	GobJournalSegmentBytes int64
+	// Journal segments are deleted when older than GobJournalRetentionSeconds, or when the whole
+	// journal is larger than GobJournalRetentionBytes. Zero means no limit.
+	GobJournalRetentionSeconds int
+	GobJournalRetentionBytes   int64
+	// AppCatchUpOnStart makes Apps fetch the history of the latest session from a Gob before going live
+	AppCatchUpOnStart bool
 	// MaxSendsInFlight defines the maximum number of un-acknowledged sends that are allowed
 	MaxSendsInFlight int
+	// SendQueueMaxCapacity is the number of entries an App send queue may grow to
+	SendQueueMaxCapacity int
+	// The Hub packs App messages together in one Hub message of at most HubMaxDatagramSize bytes,
+	// waiting at most HubMaxLingerMicroseconds for more App messages. No waiting if zero.
+	HubMaxDatagramSize       int
+	HubMaxLingerMicroseconds int
+	// HubSessionFile is where the Hub saves its session ID, so the next one is always higher. Optional.
+	HubSessionFile string
+	// HubCheckpointFile is where the Hub saves the expected sequence number of each App, every
+	// HubCheckpointMilliseconds, so that Apps can carry on after a Hub restart. Optional.
+	HubCheckpointFile         string
+	HubCheckpointMilliseconds int
+	// HubRebuildFromGob makes a starting Hub bring its checkpoint up to date from a Gob
+	HubRebuildFromGob bool
+	// HubHeartbeatMilliseconds is how often a Hub sends a heartbeat when there are no App messages
+	HubHeartbeatMilliseconds int
+	// HubFailoverMilliseconds is how long a standby Hub waits without hearing from the primary Hub,
+	// before taking over
+	HubFailoverMilliseconds int
+	// AppHubTimeoutMilliseconds is how long an App waits without hearing from the Hub, before it
+	// counts the Hub as dead
+	AppHubTimeoutMilliseconds int
+	// AppGapTimeoutMilliseconds is how long an App waits for a gap to be filled further by a Gob,
+	// before giving up on the missing Hub messages. GapDefaultTimeout if zero.
+	AppGapTimeoutMilliseconds int
+	// AppStopTimeoutMilliseconds is how long StopApp waits for the Hub to accept the App messages
+	// already sent, before dropping them. AppStopDefaultTimeout if zero.
+	AppStopTimeoutMilliseconds int
+	// Fault injection, for trying out recovery from lost, duplicated, reordered, delayed and truncated
+	// datagrams. Each probability is between 0 and 1, and all of them are 0 in normal use. FaultSeed
+	// makes a run repeatable; a seed is picked if it is 0.
+	FaultDropProbability      float64
+	FaultDuplicateProbability float64
+	FaultReorderProbability   float64
+	FaultDelayProbability     float64
+	FaultMaxDelayMilliseconds int
+	FaultTruncateProbability  float64
+	FaultSeed                 int64
+	// Any of the addresses may be an IP multicast group, instead of a broadcast address. Listeners
+	// on a group join it on MulticastInterface, which is also where multicast is sent from. The
+	// system chooses the interface if it is empty. Multicast travels at most MulticastTTL hops, 1
+	// if zero, and comes back to this host too, unless MulticastDisableLoopback is set.
+	MulticastInterface       string
+	MulticastTTL             int
+	MulticastDisableLoopback bool
+	// HubUnicastFanOut makes the Hub send every Hub message to each registered App, instead of to
+	// HubRiseAddress, for networks without broadcast or multicast. Apps and Gobs register by sending
+	// to AppRiseAddress from where they listen, and registrations that aren't renewed within
+	// HubRegistrationTimeoutMilliseconds expire. AppSinkAddress may have port 0, so that several
+	// Apps can listen on the same host.
+	HubUnicastFanOut                   bool
+	HubRegistrationTimeoutMilliseconds int
 }
 
 // AppCommData is for handling communication from an App to the Hub
@@ -56,6 +183,7 @@ type HubCommData struct {
 	SessionID                 uint64
 	HubSequenceNumber         uint64
 	NumberOfAppPayloads       uint16 // If we put together several App in one Hub
+	ExpectedSessionID         uint64 // Zero until the first Hub message has been received
 	ExpectedHubSequenceNumber uint64
 	// Temporary buffer storage for data
 	SessionIDBuffer           []byte
@@ -64,16 +192,56 @@ type HubCommData struct {
 	Payload                   []byte
 	// The actual data as bytes that will be sent over UDP
 	MasterBuffer []byte
+	// Hub messages received ahead of a gap, waiting for the gap to be filled by a Gob
+	PendingMessages        map[uint64][]byte
+	NewestPendingSequence  uint64
+	GapRequestedToSequence uint64
+	GapRequestTime         time.Time
+	GapFillProgress        uint64    // ExpectedHubSequenceNumber when the gap was last looked at
+	GapProgressTime        time.Time // When the gap was last filled further
+	// GapTimeout is how long a gap may go without any of it being filled. The missing Hub messages
+	// are then given up on, GapUnrecoverable is called with their range, and delivery goes on after
+	// them. Never given up on if zero.
+	GapTimeout       time.Duration
+	GapUnrecoverable func(sessionID uint64, fromSequence uint64, toSequence uint64)
+	// Hub sequence number of the next Hub message, according to the latest heartbeat. Anything
+	// before it that hasn't arrived was lost, even if no later Hub message has arrived to show it.
+	HeartbeatHubSequenceNumber uint64
+	// RequestGap is called with the range of Hub sequence numbers that need to be fetched from a Gob
+	RequestGap func(sessionID uint64, fromSequence uint64, toSequence uint64)
+	// Hub messages of a newer session, kept until every Hub message of the current session has been
+	// delivered. The first Hub message of a session announces where the previous one ended, and
+	// SessionEndKnown is set once it has been seen. HeartbeatHubSequenceNumber then holds the end.
+	NextSessionID          uint64
+	NextSessionMessages    map[uint64][]byte
+	NextSessionHeartbeat   uint64
+	NextSessionTime        time.Time // When the first Hub message of the newer session arrived
+	NextSessionRequestTime time.Time
+	SessionEndKnown        bool
+	// CatchingUp is set while history is being fetched from a Gob at startup. Live Hub messages
+	// are kept as pending meanwhile, without asking for gaps to be filled. It also makes the first
+	// session start from its beginning, rather than from the first Hub message heard.
+	CatchingUp bool
+	// SessionChanged is called when Hub messages from a new session start arriving, for example
+	// after the Hub has been restarted. oldSessionID is zero for the first session seen.
+	SessionChanged func(oldSessionID uint64, newSessionID uint64)
+	// LastHeardTime is when a Hub message or heartbeat of the current session last arrived.
+	// HubAlive is false until the first one, and when nothing has arrived for HubTimeout.
+	// LivenessChanged is called whenever HubAlive changes.
+	LastHeardTime   time.Time
+	HubAlive        bool
+	HubTimeout      time.Duration
+	LivenessChanged func(alive bool)
 }
 
-// AppState handles the internal state of an App, especially regarding sending data
+// AppState handles the internal state of an App, especially regarding sending data.
+// Sent messages stay in SendQueue until they have been seen on the Hub broadcast.
 type AppState struct {
-	ID                uint64
-	QueueEntries      uint
-	QueueHeadLocation uint
-	QueueCapacity     uint
-	InFlightMarker    uint
-	SendQueue         [][]byte
+	ID               uint64
+	MaxSendsInFlight int
+	SendQueue        SendQueue
+	// When the queued messages were last sent
+	LastSendTime time.Time
 }
 
 // InitAppMessage initializes all the message parameters
@@ -91,80 +259,379 @@ func InitAppMessage(data *AppCommData) {
 	data.MasterBuffer = make([]byte, 0, BufferAllocationSize)
 }
 
-// InitHubMessage initializes all the message parameters
+// InitHubMessage initializes all the message parameters. A Hub sets SessionID from NewSessionID.
 func InitHubMessage(data *HubCommData) {
-	data.SessionID = 31337
+	data.SessionID = 0
 	data.HubSequenceNumber = 0
-	data.NumberOfAppPayloads = 1 // To begin with only ever 1 App in one Hub msg
+	data.NumberOfAppPayloads = 0 // Counted up as App messages are appended
+	data.ExpectedSessionID = 0
 	data.ExpectedHubSequenceNumber = 0
 	data.SessionIDBuffer = make([]byte, 8)
 	data.HubSequenceNumberBuffer = make([]byte, 8)
 	data.NumberOfAppPayloadsBuffer = make([]byte, 2)
 	data.Payload = make([]byte, 0, BufferAllocationSize)
 	data.MasterBuffer = make([]byte, 0, BufferAllocationSize)
+	data.PendingMessages = make(map[uint64][]byte)
+	data.NewestPendingSequence = 0
+	data.GapRequestedToSequence = 0
+	data.GapRequestTime = time.Time{}
+	data.GapFillProgress = 0
+	data.GapProgressTime = time.Time{}
+	data.GapTimeout = GapDefaultTimeout
+	data.HeartbeatHubSequenceNumber = 0
+	data.NextSessionID = 0
+	data.NextSessionMessages = make(map[uint64][]byte)
+	data.NextSessionHeartbeat = 0
+	data.NextSessionTime = time.Time{}
+	data.NextSessionRequestTime = time.Time{}
+	data.SessionEndKnown = false
+	data.CatchingUp = false
+	data.LastHeardTime = time.Time{}
+	data.HubAlive = false
+	data.HubTimeout = HubDefaultTimeout
 }
 
 // InitAppState initializes the data structure for an App state
-func InitAppState(ID uint64) AppState {
+func InitAppState(ID uint64, configuration Configuration) AppState {
 	var state AppState
 	state.ID = ID
-	state.QueueEntries = 0
-	state.QueueHeadLocation = 0
-	state.QueueCapacity = SendQueueSizeInitialSize
-	state.InFlightMarker = 0
-	state.SendQueue = make([][]byte, SendQueueSizeInitialSize)
-	for i := range state.SendQueue {
-		state.SendQueue[i] = make([]byte, BufferAllocationSize)
+	maxCapacity := configuration.SendQueueMaxCapacity
+	if maxCapacity <= 0 {
+		maxCapacity = SendQueueDefaultMaxCapacity
+	}
+	InitSendQueue(&state.SendQueue, SendQueueSizeInitialSize, maxCapacity)
+	state.MaxSendsInFlight = configuration.MaxSendsInFlight
+	if state.MaxSendsInFlight <= 0 || state.MaxSendsInFlight > state.SendQueue.MaxCapacity {
+		state.MaxSendsInFlight = state.SendQueue.MaxCapacity
 	}
+	state.LastSendTime = time.Time{}
 	return state
 }
 
-// DecodeHubMessage decodes the bytes in a message from a Hub
-func DecodeHubMessage(data *HubCommData) bool {
+// DecodeHubHeader decodes the header fields of a message from a Hub, without looking at sequencing.
+// Returns an error if the App messages don't exactly fill the rest of the frame, since the frame
+// is then damaged, and has to be fetched again like a lost one.
+func DecodeHubHeader(data *HubCommData) error {
+	if len(data.MasterBuffer) < HubHeaderSize {
+		return ErrShortFrame
+	}
 	data.SessionID = binary.BigEndian.Uint64(data.MasterBuffer[0:8])
 	data.HubSequenceNumber = binary.BigEndian.Uint64(data.MasterBuffer[8:16])
 	data.NumberOfAppPayloads = binary.BigEndian.Uint16(data.MasterBuffer[16:18])
-	data.Payload = data.MasterBuffer[18:]
+	data.Payload = data.MasterBuffer[HubHeaderSize:]
+	var appMessages AppMessageIterator
+	var appData AppCommData
+	InitAppMessageIterator(&appMessages, data)
+	for NextAppMessage(&appMessages, &appData) {
+	}
+	return appMessages.Err
+}
+
+// DecodeHubMessage decodes the bytes in a message from a Hub. MasterBuffer must hold exactly the
+// received frame. Returns true if the message is next in sequence and should be delivered, or an
+// error if the frame is malformed.
+func DecodeHubMessage(data *HubCommData) (bool, error) {
+	if err := DecodeHubHeader(data); err != nil {
+		return false, err
+	}
+
+	// Session IDs only ever go up, so a lower one is left over from an earlier session
+	if data.SessionID < data.ExpectedSessionID {
+		return false, nil
+	}
+	data.LastHeardTime = time.Now()
+	if !data.HubAlive {
+		setHubAlive(data, true)
+	}
+	// A newer session waits until the current one is complete
+	if data.SessionID > data.ExpectedSessionID {
+		keepForNextSession(data)
+		if data.ExpectedSessionID != 0 && !currentSessionComplete(data) {
+			return false, nil
+		}
+		startHubSession(data)
+		return NextPendingHubMessage(data), nil
+	}
+	if IsHubHeartbeat(data) {
+		// A heartbeat shows which Hub messages should have arrived by now, so losing the last
+		// ones before the Hub goes quiet is noticed too
+		if data.HubSequenceNumber > data.HeartbeatHubSequenceNumber {
+			data.HeartbeatHubSequenceNumber = data.HubSequenceNumber
+		}
+		RequestMissingHubMessages(data)
+		return false, nil
+	}
 	/*
-		Here's how the gap detection should work for an App listening to Hub:
+		Here's how the gap detection works for an App listening to Hub:
 		- At initialization, set ExpectedHubSequenceNumber to 0
 		- Read the Hub message, and decode HubSequenceNumber
 		- if ExpectedHubSequenceNumber == HubSequenceNumber then
-		-   increment ExpectedHubSequenceNumber
+		-   deliver the message, and increment ExpectedHubSequenceNumber
+		-   deliver any pending messages that are now in sequence
 		- else
-		-   report a sequence number gap, and ask for the gaps to be filled
-		-   ExpectedHubSequenceNumber = HubSequenceNumber + 1
+		-   keep the message as pending, and ask a Gob for the missing ones
 
-		Hub sequence number handling should have three possible scenarios:
+		Hub sequence number handling has three possible scenarios:
 		- expected sequence number - continue
-		- higher sequence number than expected - report gap, request lost data
+		- higher sequence number than expected - keep message, request lost data
 		- lower sequence number than expected - do nothing
 	*/
 
 	if data.ExpectedHubSequenceNumber < data.HubSequenceNumber {
-		// Here we should have code to fill gaps from a "gob"
-		fmt.Println("**************** Sequence number", data.HubSequenceNumber, "not expected. Too high. Expecting", data.ExpectedHubSequenceNumber, "We should try to re-fetch ", data.ExpectedHubSequenceNumber, "-", data.HubSequenceNumber-1, "before continuing.")
-		data.ExpectedHubSequenceNumber = data.HubSequenceNumber + 1 // Just continue without missing data, for now
-		return true
-		// return false
+		if _, ok := data.PendingMessages[data.HubSequenceNumber]; !ok && len(data.PendingMessages) < MaxPendingHubMessages {
+			// MasterBuffer is reused for the next read, so keep a copy
+			pending := make([]byte, len(data.MasterBuffer))
+			copy(pending, data.MasterBuffer)
+			data.PendingMessages[data.HubSequenceNumber] = pending
+			if data.HubSequenceNumber > data.NewestPendingSequence {
+				data.NewestPendingSequence = data.HubSequenceNumber
+			}
+		}
+		RequestMissingHubMessages(data)
+		return false, nil
 	} else if data.ExpectedHubSequenceNumber != data.HubSequenceNumber {
 		// Do nothing, and wait for the sequence numbers to catch up.
-		fmt.Println("**************** Sequence number", data.HubSequenceNumber, "not expected. Too low. Expecting", data.ExpectedHubSequenceNumber)
+		return false, nil
+	}
+	return true, nil
+}
+
+// keepForNextSession keeps the Hub message just decoded, from a session newer than the current
+// one, until the current session is complete. A still newer session replaces it.
+func keepForNextSession(data *HubCommData) {
+	if data.SessionID > data.NextSessionID {
+		data.NextSessionID = data.SessionID
+		data.NextSessionMessages = make(map[uint64][]byte)
+		data.NextSessionHeartbeat = 0
+		data.NextSessionTime = time.Now()
+		data.NextSessionRequestTime = time.Time{}
+		data.SessionEndKnown = false
+	}
+	if IsHubHeartbeat(data) {
+		if data.HubSequenceNumber > data.NextSessionHeartbeat {
+			data.NextSessionHeartbeat = data.HubSequenceNumber
+		}
+		return
+	}
+	if _, ok := data.NextSessionMessages[data.HubSequenceNumber]; !ok && len(data.NextSessionMessages) < MaxPendingHubMessages {
+		pending := make([]byte, len(data.MasterBuffer))
+		copy(pending, data.MasterBuffer)
+		data.NextSessionMessages[data.HubSequenceNumber] = pending
+	}
+}
+
+// currentSessionComplete tells if every Hub message of the current session has been delivered, so
+// that the next session can start. The first Hub message of the next session tells where the current
+// one ended, and it is asked for if it hasn't arrived. Until then, and if it announces some other
+// session, the end is the newest Hub message or heartbeat seen. Whatever is missing up to the end is
+// asked for, and after HubSessionChangeTimeout the next session starts anyway.
+func currentSessionComplete(data *HubCommData) bool {
+	if time.Since(data.NextSessionTime) >= HubSessionChangeTimeout {
+		return true
+	}
+	if !data.SessionEndKnown {
+		if frame, ok := data.NextSessionMessages[0]; ok {
+			previousSessionID, previousEnd, ok := DecodeSessionAnnouncement(frame)
+			if ok && previousSessionID == data.ExpectedSessionID && previousEnd > data.HeartbeatHubSequenceNumber {
+				data.HeartbeatHubSequenceNumber = previousEnd
+			}
+			data.SessionEndKnown = true
+		} else if data.RequestGap != nil && !data.CatchingUp && time.Since(data.NextSessionRequestTime) >= GapRequestTimeout {
+			data.RequestGap(data.NextSessionID, 0, 0)
+			data.NextSessionRequestTime = time.Now()
+		}
+	}
+	RequestMissingHubMessages(data)
+	return data.SessionEndKnown && len(data.PendingMessages) == 0 && data.ExpectedHubSequenceNumber >= data.HeartbeatHubSequenceNumber
+}
+
+// DecodeSessionAnnouncement reads where the previous session ended, from the first Hub message of
+// a session. Returns false if the frame doesn't start with a MessageTypeHubSessionStart App message.
+func DecodeSessionAnnouncement(frame []byte) (uint64, uint64, bool) {
+	const size = HubHeaderSize + AppHeaderSize + SessionAnnouncementSize
+	if len(frame) < size || binary.BigEndian.Uint16(frame[16:18]) == 0 {
+		return 0, 0, false
+	}
+	appMessage := frame[HubHeaderSize:]
+	if binary.BigEndian.Uint16(appMessage[0:2]) != MessageTypeHubSessionStart || binary.BigEndian.Uint16(appMessage[2:4]) != SessionAnnouncementSize {
+		return 0, 0, false
+	}
+	announcement := appMessage[AppHeaderSize:]
+	return binary.BigEndian.Uint64(announcement[0:8]), binary.BigEndian.Uint64(announcement[8:16]), true
+}
+
+// EncodeSessionAnnouncement puts together the App message a Hub starts its session with, telling
+// where the previous session ended. previousHubSequenceNumber is the next Hub sequence number of
+// the previous session. Both are zero if the previous session isn't known.
+func EncodeSessionAnnouncement(data *AppCommData, previousSessionID uint64, previousHubSequenceNumber uint64) {
+	data.Type = MessageTypeHubSessionStart
+	data.ID = 0
+	data.AppSequenceNumber = 0
+	data.Payload = make([]byte, SessionAnnouncementSize)
+	binary.BigEndian.PutUint64(data.Payload[0:8], previousSessionID)
+	binary.BigEndian.PutUint64(data.Payload[8:16], previousHubSequenceNumber)
+	EncodeAppMessage(data)
+}
+
+// startHubSession starts expecting Hub messages from the beginning of the next session, with the
+// Hub messages already received from it. Anything still missing from the current session is lost.
+// The first session starts from the first Hub message heard instead, unless catching up, since
+// what was sent before is history that wasn't asked for.
+func startHubSession(data *HubCommData) {
+	oldSessionID := data.ExpectedSessionID
+	data.ExpectedSessionID = data.NextSessionID
+	data.ExpectedHubSequenceNumber = 0
+	if oldSessionID == 0 && !data.CatchingUp {
+		data.ExpectedHubSequenceNumber = data.NextSessionHeartbeat
+		first := true
+		for sequence := range data.NextSessionMessages {
+			if first || sequence < data.ExpectedHubSequenceNumber {
+				data.ExpectedHubSequenceNumber = sequence
+				first = false
+			}
+		}
+	}
+	data.PendingMessages = data.NextSessionMessages
+	data.NewestPendingSequence = 0
+	for sequence := range data.PendingMessages {
+		if sequence > data.NewestPendingSequence {
+			data.NewestPendingSequence = sequence
+		}
+	}
+	data.GapRequestedToSequence = 0
+	data.GapRequestTime = time.Time{}
+	data.GapFillProgress = 0
+	data.GapProgressTime = time.Time{}
+	data.HeartbeatHubSequenceNumber = data.NextSessionHeartbeat
+	data.NextSessionID = 0
+	data.NextSessionMessages = make(map[uint64][]byte)
+	data.NextSessionHeartbeat = 0
+	data.SessionEndKnown = false
+	if data.SessionChanged != nil {
+		data.SessionChanged(oldSessionID, data.ExpectedSessionID)
+	}
+}
+
+// NextPendingHubMessage decodes the next expected Hub message, if it has already been received
+// ahead of a gap, or goes on with the next session once the current one is complete. Call it after
+// each delivered message, and regularly, until it returns false.
+func NextPendingHubMessage(data *HubCommData) bool {
+	pending, ok := data.PendingMessages[data.ExpectedHubSequenceNumber]
+	if !ok {
+		if data.NextSessionID != 0 && currentSessionComplete(data) {
+			startHubSession(data)
+			return NextPendingHubMessage(data)
+		}
+		RequestMissingHubMessages(data)
+		if skipUnrecoverableGap(data) {
+			return NextPendingHubMessage(data)
+		}
 		return false
 	}
-	// fmt.Println("Hub session:", data.SessionID)
-	// fmt.Println("Hub sequence:", data.HubSequenceNumber)
-	// fmt.Println("Hub App payloads:", data.NumberOfAppPayloads)
+	delete(data.PendingMessages, data.ExpectedHubSequenceNumber)
+	data.MasterBuffer = pending
+	deliver, _ := DecodeHubMessage(data) // Already known to be well formed
+	return deliver
+}
+
+// RequestMissingHubMessages asks for the Hub messages between the expected sequence number and the
+// newest pending message, or the latest heartbeat, unless they have already been asked for, and the
+// gap has been filled further, within GapRequestTimeout
+func RequestMissingHubMessages(data *HubCommData) {
+	if data.CatchingUp {
+		return
+	}
+	gapEnd := data.HeartbeatHubSequenceNumber
+	if len(data.PendingMessages) > 0 && data.NewestPendingSequence > gapEnd {
+		gapEnd = data.NewestPendingSequence
+	}
+	if gapEnd <= data.ExpectedHubSequenceNumber {
+		return
+	}
+	fromSequence := data.ExpectedHubSequenceNumber
+	toSequence := gapEnd - 1
+	// A gap that is being filled, for example streamed over TCP, isn't asked for again
+	if data.GapFillProgress != data.ExpectedHubSequenceNumber {
+		data.GapFillProgress = data.ExpectedHubSequenceNumber
+		data.GapRequestTime = time.Now()
+		data.GapProgressTime = time.Now()
+	}
+	if data.GapProgressTime.IsZero() {
+		data.GapProgressTime = time.Now()
+	}
+	if data.RequestGap == nil {
+		return
+	}
+	if time.Since(data.GapRequestTime) < GapRequestTimeout {
+		// Only ask for what is newer than the outstanding request
+		if data.GapRequestedToSequence >= toSequence {
+			return
+		}
+		if data.GapRequestedToSequence >= fromSequence {
+			fromSequence = data.GapRequestedToSequence + 1
+		}
+	}
+	if fromSequence > toSequence {
+		return
+	}
+	data.RequestGap(data.ExpectedSessionID, fromSequence, toSequence)
+	data.GapRequestedToSequence = toSequence
+	// Asking only for the newer part doesn't put off asking for the whole gap again
+	if fromSequence == data.ExpectedHubSequenceNumber {
+		data.GapRequestTime = time.Now()
+	}
+}
+
+// skipUnrecoverableGap gives up on the Hub messages missing before the next one received, or before
+// the latest heartbeat, when nothing of the gap has been filled for GapTimeout. Returns true if it
+// did, so that delivery can go on.
+func skipUnrecoverableGap(data *HubCommData) bool {
+	if data.GapTimeout <= 0 || data.CatchingUp || data.GapProgressTime.IsZero() || data.GapFillProgress != data.ExpectedHubSequenceNumber || time.Since(data.GapProgressTime) < data.GapTimeout {
+		return false
+	}
+	skipTo := data.HeartbeatHubSequenceNumber
+	for sequence := range data.PendingMessages {
+		if sequence > data.ExpectedHubSequenceNumber && (skipTo <= data.ExpectedHubSequenceNumber || sequence < skipTo) {
+			skipTo = sequence
+		}
+	}
+	if skipTo <= data.ExpectedHubSequenceNumber {
+		return false
+	}
+	if data.GapUnrecoverable != nil {
+		data.GapUnrecoverable(data.ExpectedSessionID, data.ExpectedHubSequenceNumber, skipTo-1)
+	}
+	data.ExpectedHubSequenceNumber = skipTo
+	data.GapProgressTime = time.Time{}
 	return true
 }
 
-// HubDecodeAppMessage decodes the bytes in a message from an App
-func HubDecodeAppMessage(data *AppCommData, expectedSequenceForApp *map[uint64]uint64) bool {
-	data.Type = binary.BigEndian.Uint16(data.MasterBuffer[0:2])
-	data.PayloadSize = binary.BigEndian.Uint16(data.MasterBuffer[2:4])
-	data.ID = binary.BigEndian.Uint64(data.MasterBuffer[4:12])
-	data.AppSequenceNumber = binary.BigEndian.Uint64(data.MasterBuffer[12:20])
-	data.Payload = data.MasterBuffer[20 : 20+data.PayloadSize]
+// CheckHubLiveness counts the Hub as dead if nothing has been heard from it for HubTimeout. Call it
+// regularly, since no Hub messages arrive to trigger it when the Hub is dead.
+func CheckHubLiveness(data *HubCommData) {
+	if data.HubAlive && time.Since(data.LastHeardTime) >= data.HubTimeout {
+		setHubAlive(data, false)
+	}
+}
+
+func setHubAlive(data *HubCommData, alive bool) {
+	data.HubAlive = alive
+	if data.LivenessChanged != nil {
+		data.LivenessChanged(alive)
+	}
+}
+
+// HubDecodeAppMessage decodes the bytes in a message from an App. MasterBuffer must hold exactly
+// the received frame. Returns true if the message is next in sequence for the App, or an error if
+// the frame is malformed, or of a system message type an App may not send.
+func HubDecodeAppMessage(data *AppCommData, expectedSequenceForApp *map[uint64]uint64) (bool, error) {
+	if err := AppDecodeAppMessage(data); err != nil {
+		return false, err
+	}
+	// It could never be sent on in a Hub message
+	if HubHeaderSize+AppHeaderSize+int(data.PayloadSize) > BufferAllocationSize {
+		return false, ErrAppMessageTooLarge
+	}
 
 	/*
 		Here's how the Hub gap handling should work:
@@ -180,40 +647,81 @@ func HubDecodeAppMessage(data *AppCommData, expectedSequenceForApp *map[uint64]u
 		- lower sequence number than expected - do nothing
 	*/
 
-	if _, ok := (*expectedSequenceForApp)[data.ID]; ok {
-		fmt.Println("found pre-existing entry for app id", data.ID)
-	} else {
-		fmt.Println("couldn't find a previous entry for app id", data.ID)
-		(*expectedSequenceForApp)[data.ID] = 0
+	// An App starting a new run, or telling a new Hub where it is, says which App sequence number
+	// comes next. It may only move forward, so nothing already accepted is accepted again. Other
+	// system messages from an App are sequenced like any App message, if they are meant for Apps.
+	if data.Type == MessageTypeSessionStart {
+		if data.AppSequenceNumber < (*expectedSequenceForApp)[data.ID] {
+			return false, nil
+		}
+		(*expectedSequenceForApp)[data.ID] = data.AppSequenceNumber
+		return true, nil
+	}
+	if IsSystemMessageType(data.Type) && !IsSequencedSystemMessageType(data.Type) {
+		return false, ErrMessageTypeReserved
 	}
 
+	// Do nothing with an App message out of sequence, and wait for the sequence numbers to catch up
 	if (*expectedSequenceForApp)[data.ID] != data.AppSequenceNumber {
-		// Do nothing, and wait for the sequence numbers to catch up.
-		fmt.Println("**************** Sequence number", data.AppSequenceNumber, "not expected. Expecting", (*expectedSequenceForApp)[data.ID])
-		return false
+		return false, nil
 	}
-	fmt.Println("App type:", data.Type)
-	fmt.Println("App size:", data.PayloadSize)
-	fmt.Println("App id:", data.ID)
-	fmt.Println("App sequence number:", data.AppSequenceNumber)
-	fmt.Printf("App payload: \"%s\"\n", string(data.Payload))
 	(*expectedSequenceForApp)[data.ID]++
-	return true
+	return true, nil
+}
 
+// UpdateExpectedAppSequence moves the expected App sequence number of an App past an App message
+// the Hub has sequenced, for following the Hub messages of another Hub
+func UpdateExpectedAppSequence(expectedSequenceForApp map[uint64]uint64, data *AppCommData) {
+	switch {
+	case data.Type == MessageTypeSessionStart:
+		if data.AppSequenceNumber > expectedSequenceForApp[data.ID] {
+			expectedSequenceForApp[data.ID] = data.AppSequenceNumber
+		}
+	case IsSystemMessageType(data.Type) && !IsSequencedSystemMessageType(data.Type):
+	case data.AppSequenceNumber >= expectedSequenceForApp[data.ID]:
+		expectedSequenceForApp[data.ID] = data.AppSequenceNumber + 1
+	}
 }
 
-// AppDecodeAppMessage decodes the bytes in a message from an App
-func AppDecodeAppMessage(data *AppCommData) bool {
-	data.Type = binary.BigEndian.Uint16(data.MasterBuffer[0:2])
+// AppDecodeAppMessage decodes the bytes in a message from an App. Returns an error if MasterBuffer
+// is too short for the header, or for the payload size given in the header.
+func AppDecodeAppMessage(data *AppCommData) error {
+	if len(data.MasterBuffer) < AppHeaderSize {
+		return ErrShortFrame
+	}
 	data.PayloadSize = binary.BigEndian.Uint16(data.MasterBuffer[2:4])
+	if AppHeaderSize+int(data.PayloadSize) > len(data.MasterBuffer) {
+		return ErrPayloadOverrun
+	}
+	data.Type = binary.BigEndian.Uint16(data.MasterBuffer[0:2])
 	data.ID = binary.BigEndian.Uint64(data.MasterBuffer[4:12])
 	data.AppSequenceNumber = binary.BigEndian.Uint64(data.MasterBuffer[12:20])
-	data.Payload = data.MasterBuffer[20 : 20+data.PayloadSize]
-	return true
+	data.Payload = data.MasterBuffer[AppHeaderSize : AppHeaderSize+int(data.PayloadSize)]
+	return nil
+}
+
+// SendSessionStart tells the Hub that the next App message from an App has the given App sequence
+// number. The Hub accepts it if that is no lower than what it expects from the App.
+func SendSessionStart(connection net.Conn, ID uint64, sequence uint64) error {
+	var data AppCommData
+	InitAppMessage(&data)
+	data.Type = MessageTypeSessionStart
+	data.ID = ID
+	data.AppSequenceNumber = sequence
+	EncodeAppMessage(&data)
+	_, err := connection.Write(data.MasterBuffer)
+	return err
 }
 
 // SendAppMessage encodes as bytes and send an App message to the hub
-func SendAppMessage(data *AppCommData, connection *net.UDPConn) {
+func SendAppMessage(data *AppCommData, connection net.Conn) {
+	EncodeAppMessage(data)
+	connection.Write(data.MasterBuffer)
+	data.AppSequenceNumber++ // Increment App sequence number every time we've sent a datagram
+}
+
+// EncodeAppMessage encodes the fields of an App message as bytes in the master buffer
+func EncodeAppMessage(data *AppCommData) {
 	// Clear data buffers
 	data.MasterBuffer = data.MasterBuffer[:0] // Clear the byte slice send buffer
 
@@ -233,9 +741,66 @@ func SendAppMessage(data *AppCommData, connection *net.UDPConn) {
 
 	// Add payload to master output buffer
 	data.MasterBuffer = append(data.MasterBuffer, data.Payload...)
+}
+
+// QueueAppMessage sends an App message to the hub, and keeps it in the send queue until it has
+// been acknowledged. Returns ErrTooManySendsInFlight, without sending, if MaxSendsInFlight
+// messages are already waiting.
+func QueueAppMessage(state *AppState, data *AppCommData, connection net.Conn) error {
+	if state.SendQueue.Length >= state.MaxSendsInFlight {
+		return ErrTooManySendsInFlight
+	}
+	data.ID = state.ID
+	EncodeAppMessage(data)
+	if err := PushSendQueue(&state.SendQueue, data.AppSequenceNumber, data.MasterBuffer); err != nil {
+		return err
+	}
+	if state.SendQueue.Length == 1 {
+		state.LastSendTime = time.Now()
+	}
 
 	connection.Write(data.MasterBuffer)
 	data.AppSequenceNumber++ // Increment App sequence number every time we've sent a datagram
+	return nil
+}
+
+// AcknowledgeAppMessage removes messages from the send queue, when an App message from the Hub
+// broadcast shows that the Hub has accepted them. The Hub accepts the messages of an App in
+// sequence order, so seeing one message acknowledges all earlier ones too. System messages other
+// than those sequenced like App messages are never queued, so they acknowledge nothing. Returns ErrAcknowledgeMismatch, without acknowledging
+// anything, if the App message isn't the queued one. MasterBuffer must hold the App message.
+func AcknowledgeAppMessage(state *AppState, data *AppCommData) error {
+	if data.ID != state.ID || IsSystemMessageType(data.Type) && !IsSequencedSystemMessageType(data.Type) {
+		return nil
+	}
+	queue := &state.SendQueue
+	if data.AppSequenceNumber < queue.HeadSequenceNumber {
+		return nil
+	}
+	queued, ok := PeekSendQueue(queue, int(data.AppSequenceNumber-queue.HeadSequenceNumber))
+	if !ok {
+		return nil
+	}
+	if !bytes.Equal(queued, data.MasterBuffer) {
+		return ErrAcknowledgeMismatch
+	}
+	if AcknowledgeSendQueue(queue, data.AppSequenceNumber) > 0 {
+		state.LastSendTime = time.Now()
+	}
+	return nil
+}
+
+// RetransmitAppMessages sends all queued messages again, oldest first, if none of them has been
+// acknowledged within AppRetransmitTimeout. The Hub ignores the ones it already has.
+func RetransmitAppMessages(state *AppState, connection net.Conn) {
+	if state.SendQueue.Length == 0 || time.Since(state.LastSendTime) < AppRetransmitTimeout {
+		return
+	}
+	for position := 0; position < state.SendQueue.Length; position++ {
+		message, _ := PeekSendQueue(&state.SendQueue, position)
+		connection.Write(message)
+	}
+	state.LastSendTime = time.Now()
 }
 
 // GetConfiguration fetches configuration parameters from JSON file
@@ -247,14 +812,69 @@ func GetConfiguration(filename string) Configuration {
 	err := decoder.Decode(&configuration)
 	if err != nil {
 		fmt.Println("error:", err)
+	} else if err = ValidateConfiguration(configuration); err != nil {
+		fmt.Println("error:", err)
 	}
 	return configuration
 }
 
-// SendHubMessage encodes as bytes and send a Hub message to the apps
-func SendHubMessage(sinkData *AppCommData, riseData *HubCommData, connection *net.UDPConn) {
+// SendHubMessage encodes as bytes and send a Hub message to the apps, with a single App message
+func SendHubMessage(sinkData *AppCommData, riseData *HubCommData, connection io.Writer) error {
+	AppendHubMessage(sinkData, riseData)
+	return FlushHubMessage(riseData, connection)
+}
+
+// HubMessageSize returns the size the Hub message would have, with an App message added to it
+func HubMessageSize(sinkData *AppCommData, riseData *HubCommData) int {
+	return HubHeaderSize + len(riseData.Payload) + AppHeaderSize + int(sinkData.PayloadSize)
+}
 
-	fmt.Println("riseData.NumberOfAppPayloads", riseData.NumberOfAppPayloads)
+// AppendHubMessage adds a received App message to the payload of the next Hub message
+func AppendHubMessage(sinkData *AppCommData, riseData *HubCommData) {
+	appDataSize := sinkData.PayloadSize + AppHeaderSize // Size of App packet
+	riseData.Payload = append(riseData.Payload, sinkData.MasterBuffer[0:appDataSize]...)
+	riseData.NumberOfAppPayloads++
+}
+
+// FlushHubMessage encodes as bytes and sends a Hub message to the apps, with all the App messages
+// appended since the last one. Nothing is sent if there are no App messages. If it can't be sent,
+// the error is returned, and the App messages are kept to be flushed again with the same Hub
+// sequence number, so that no Hub sequence number is used up without a Hub message.
+func FlushHubMessage(riseData *HubCommData, connection io.Writer) error {
+	if riseData.NumberOfAppPayloads == 0 {
+		return nil
+	}
+	encodeHubMessage(riseData)
+	if _, err := connection.Write(riseData.MasterBuffer); err != nil {
+		return err
+	}
+	riseData.HubSequenceNumber++ // Increment App sequence number every time we've sent a datagram
+
+	// Start collecting App messages for the next Hub message
+	riseData.Payload = riseData.Payload[:0]
+	riseData.NumberOfAppPayloads = 0
+	return nil
+}
+
+// SendHubHeartbeat sends a Hub message without App messages, to show that the Hub is alive. It has
+// the Hub sequence number of the next Hub message, which isn't used up. Only call it when no App
+// messages are waiting to be flushed.
+func SendHubHeartbeat(riseData *HubCommData, connection io.Writer) error {
+	if riseData.NumberOfAppPayloads != 0 {
+		return nil
+	}
+	encodeHubMessage(riseData)
+	_, err := connection.Write(riseData.MasterBuffer)
+	return err
+}
+
+// IsHubHeartbeat tells if a decoded Hub message is a heartbeat, rather than one with App messages
+func IsHubHeartbeat(data *HubCommData) bool {
+	return data.NumberOfAppPayloads == 0
+}
+
+// encodeHubMessage encodes the header and App messages of a Hub message into MasterBuffer
+func encodeHubMessage(riseData *HubCommData) {
 	// Clear riseData buffers
 	riseData.MasterBuffer = riseData.MasterBuffer[:0] // Clear the byte slice send buffer
 
@@ -269,10 +889,36 @@ func SendHubMessage(sinkData *AppCommData, riseData *HubCommData, connection *ne
 	riseData.MasterBuffer = append(riseData.MasterBuffer, riseData.NumberOfAppPayloadsBuffer...)
 
 	// Add payload to master output buffer
-	appDataSize := sinkData.PayloadSize + 20 // Size of App packet
-	riseData.MasterBuffer = append(riseData.MasterBuffer, sinkData.MasterBuffer[0:appDataSize]...)
-	connection.Write(riseData.MasterBuffer)
-	riseData.HubSequenceNumber++ // Increment App sequence number every time we've sent a datagram
+	riseData.MasterBuffer = append(riseData.MasterBuffer, riseData.Payload...)
+}
+
+// NewSessionID generates a session ID for a starting Hub. Session IDs are based on the time, so a
+// restarted Hub gets a higher session ID than before. If sessionFile isn't empty, the session ID is
+// saved there, and is made higher than the one saved before, even if the clock has gone backwards.
+func NewSessionID(sessionFile string) (uint64, error) {
+	sessionID := uint64(time.Now().UnixNano())
+	if sessionFile == "" {
+		return sessionID, nil
+	}
+	saved, err := ioutil.ReadFile(sessionFile)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err == nil {
+		previous, err := strconv.ParseUint(strings.TrimSpace(string(saved)), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if sessionID <= previous {
+			sessionID = previous + 1
+		}
+	}
+	// Write to a temporary file first, so a crash can't leave a half written session ID behind
+	temporaryFile := sessionFile + ".tmp"
+	if err := ioutil.WriteFile(temporaryFile, []byte(strconv.FormatUint(sessionID, 10)+"\n"), 0644); err != nil {
+		return 0, err
+	}
+	return sessionID, os.Rename(temporaryFile, sessionFile)
 }
 
 // ControlOnConnSetupSoReusePort creates network setup for SO_REUSEPORT
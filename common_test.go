@@ -0,0 +1,188 @@
+package gonetworktest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testHubHeartbeat makes a heartbeat, with the Hub sequence number of the next Hub message
+func testHubHeartbeat(sessionID uint64, sequence uint64) []byte {
+	var hubData HubCommData
+	InitHubMessage(&hubData)
+	hubData.SessionID = sessionID
+	hubData.HubSequenceNumber = sequence
+	var frame bytes.Buffer
+	SendHubHeartbeat(&hubData, &frame)
+	return frame.Bytes()
+}
+
+// receiveTestFrame decodes a received frame, and returns the Hub sequence numbers delivered, as
+// an App does
+func receiveTestFrame(t *testing.T, data *HubCommData, frame []byte) []uint64 {
+	data.MasterBuffer = frame
+	deliver, err := DecodeHubMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliverTestFrames(data, deliver)
+}
+
+// deliverTestFrames returns the Hub sequence numbers of the Hub message just decoded, if deliver,
+// and of the pending ones now in sequence
+func deliverTestFrames(data *HubCommData, deliver bool) []uint64 {
+	var delivered []uint64
+	for ; deliver; deliver = NextPendingHubMessage(data) {
+		delivered = append(delivered, data.HubSequenceNumber)
+		data.ExpectedHubSequenceNumber++
+	}
+	return delivered
+}
+
+// TestHubSessionStart checks where the first session starts: from the first Hub message heard, or
+// from its beginning when catching up
+func TestHubSessionStart(t *testing.T) {
+	const sessionID = 7
+	tests := []struct {
+		name       string
+		catchingUp bool
+		frames     [][]byte
+		delivered  []uint64
+	}{
+		{"first Hub message", false,
+			[][]byte{testHubMessage(sessionID, 50), testHubMessage(sessionID, 51)},
+			[]uint64{50, 51}},
+		{"first heartbeat", false,
+			[][]byte{testHubHeartbeat(sessionID, 50), testHubMessage(sessionID, 51), testHubMessage(sessionID, 50)},
+			[]uint64{50, 51}},
+		{"catching up", true,
+			[][]byte{testHubMessage(sessionID, 50), testHubMessage(sessionID, 51)},
+			nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var data HubCommData
+			InitHubMessage(&data)
+			data.CatchingUp = test.catchingUp
+			var delivered []uint64
+			for _, frame := range test.frames {
+				delivered = append(delivered, receiveTestFrame(t, &data, frame)...)
+			}
+			if fmt.Sprint(delivered) != fmt.Sprint(test.delivered) {
+				t.Errorf("Delivered Hub messages %v, expected %v", delivered, test.delivered)
+			}
+			if data.ExpectedSessionID != sessionID {
+				t.Errorf("Session %d started, expected %d", data.ExpectedSessionID, sessionID)
+			}
+		})
+	}
+}
+
+// TestHubGapGivenUp loses Hub messages no Gob sends again, and checks that they are given up on
+// after GapTimeout, and that delivery goes on after them
+func TestHubGapGivenUp(t *testing.T) {
+	const sessionID = 7
+	var data HubCommData
+	InitHubMessage(&data)
+	data.GapTimeout = 50 * time.Millisecond
+	type gap struct{ sessionID, from, to uint64 }
+	var unrecoverable []gap
+	data.GapUnrecoverable = func(sessionID uint64, fromSequence uint64, toSequence uint64) {
+		unrecoverable = append(unrecoverable, gap{sessionID, fromSequence, toSequence})
+	}
+	requested := 0
+	data.RequestGap = func(sessionID uint64, fromSequence uint64, toSequence uint64) {
+		requested++
+	}
+
+	var delivered []uint64
+	for _, sequence := range []uint64{0, 3, 4} {
+		delivered = append(delivered, receiveTestFrame(t, &data, testHubMessage(sessionID, sequence))...)
+	}
+	delivered = append(delivered, deliverTestFrames(&data, NextPendingHubMessage(&data))...)
+	if fmt.Sprint(delivered) != "[0]" || len(unrecoverable) != 0 {
+		t.Fatalf("Delivered Hub messages %v before GapTimeout, expected [0]", delivered)
+	}
+	if requested == 0 {
+		t.Error("Hub messages 1 and 2 not asked for")
+	}
+
+	time.Sleep(2 * data.GapTimeout)
+	delivered = deliverTestFrames(&data, NextPendingHubMessage(&data))
+	if fmt.Sprint(delivered) != "[3 4]" {
+		t.Errorf("Delivered Hub messages %v after GapTimeout, expected [3 4]", delivered)
+	}
+	if len(unrecoverable) != 1 || unrecoverable[0] != (gap{sessionID, 1, 2}) {
+		t.Errorf("Gave up on %v, expected Hub messages 1-2 of session %d", unrecoverable, sessionID)
+	}
+}
+
+// TestHubGapAskedForAgain checks that a gap is asked for again after GapRequestTimeout, even while
+// newer Hub messages keep arriving, and are asked for on their own
+func TestHubGapAskedForAgain(t *testing.T) {
+	const sessionID = 7
+	var data HubCommData
+	InitHubMessage(&data)
+	requestedFrom := make(map[uint64]int)
+	data.RequestGap = func(sessionID uint64, fromSequence uint64, toSequence uint64) {
+		requestedFrom[fromSequence]++
+	}
+	receiveTestFrame(t, &data, testHubMessage(sessionID, 0))
+	started := time.Now()
+	for sequence := uint64(2); time.Since(started) < 2*GapRequestTimeout; sequence++ {
+		receiveTestFrame(t, &data, testHubMessage(sessionID, sequence))
+		time.Sleep(GapRequestTimeout / 10)
+	}
+	if requestedFrom[1] < 2 {
+		t.Errorf("Hub message 1 asked for %d times, expected it to be asked for again", requestedFrom[1])
+	}
+}
+
+// TestHubDecodeAppMessageTypes checks which system messages the Hub sequences like App messages
+func TestHubDecodeAppMessageTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageType uint16
+		err         error
+	}{
+		{"App message", 1, nil},
+		{"last App message type", SystemMessageTypeFirst - 1, nil},
+		{"heartbeat", MessageTypeHeartbeat, nil},
+		{"gap request", MessageTypeGapRequest, nil},
+		{"admin", MessageTypeAdmin, nil},
+		{"Hub session start", MessageTypeHubSessionStart, ErrMessageTypeReserved},
+		{"Hub registration", MessageTypeHubRegistration, ErrMessageTypeReserved},
+		{"unassigned system message type", 0xffff, ErrMessageTypeReserved},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expectedSequenceForApp := make(map[uint64]uint64)
+			var data AppCommData
+			InitAppMessage(&data)
+			data.Type = test.messageType
+			data.ID = 1
+			data.Payload = []byte("payload")
+			EncodeAppMessage(&data)
+			accepted, err := HubDecodeAppMessage(&data, &expectedSequenceForApp)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Got error %v, expected %v", err, test.err)
+			}
+			expected := uint64(0)
+			if test.err == nil {
+				expected = 1
+			}
+			if accepted != (test.err == nil) || expectedSequenceForApp[1] != expected {
+				t.Errorf("Accepted: %v, next App sequence number %d, expected %d", accepted, expectedSequenceForApp[1], expected)
+			}
+
+			// Another Hub following the sequenced App messages expects the same App sequence number
+			following := make(map[uint64]uint64)
+			UpdateExpectedAppSequence(following, &data)
+			if following[1] != expectedSequenceForApp[1] {
+				t.Errorf("Following Hub expects App sequence number %d, expected %d", following[1], expectedSequenceForApp[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package gonetworktest
+
+// Correlation of replies with the requests they answer
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// CorrelationSize is the size of the reference to the request, at the start of the payload of a reply
+const CorrelationSize = 16
+
+// ErrShortReply is returned when a reply payload is too short to hold a correlation
+var ErrShortReply = errors.New("reply too short for correlation")
+
+// Correlation identifies a request by the App that sent it, and the App sequence number it was sent
+// with. Together they are unique on the Hub broadcast.
+type Correlation struct {
+	ID                uint64
+	AppSequenceNumber uint64
+}
+
+// CorrelationOf returns the correlation of a request, for replying to it
+func CorrelationOf(request *AppCommData) Correlation {
+	return Correlation{ID: request.ID, AppSequenceNumber: request.AppSequenceNumber}
+}
+
+// EncodeReplyPayload appends the correlation of a request, followed by the body of the reply, to a
+// payload, and returns the extended payload
+func EncodeReplyPayload(payload []byte, correlation Correlation, body []byte) []byte {
+	var header [CorrelationSize]byte
+	binary.BigEndian.PutUint64(header[0:8], correlation.ID)
+	binary.BigEndian.PutUint64(header[8:16], correlation.AppSequenceNumber)
+	payload = append(payload, header[:]...)
+	return append(payload, body...)
+}
+
+// DecodeReplyPayload splits the payload of a reply into the correlation of the request, and the body
+func DecodeReplyPayload(payload []byte) (Correlation, []byte, error) {
+	if len(payload) < CorrelationSize {
+		return Correlation{}, nil, ErrShortReply
+	}
+	correlation := Correlation{
+		ID:                binary.BigEndian.Uint64(payload[0:8]),
+		AppSequenceNumber: binary.BigEndian.Uint64(payload[8:16]),
+	}
+	return correlation, payload[CorrelationSize:], nil
+}
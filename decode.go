@@ -0,0 +1,62 @@
+package gonetworktest
+
+// Bounds-checked decoding of messages
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrShortFrame is returned when there are fewer bytes left than a message header needs
+var ErrShortFrame = errors.New("frame too short for message header")
+
+// ErrPayloadOverrun is returned when the PayloadSize of an App message goes past the end of the frame
+var ErrPayloadOverrun = errors.New("App payload size goes past end of frame")
+
+// ErrAppMessageTooLarge is returned when an App message is too large to fit in a Hub message
+var ErrAppMessageTooLarge = errors.New("App message too large for a Hub message")
+
+// ErrTrailingBytes is returned when there are bytes left after the last App message in a Hub message
+var ErrTrailingBytes = errors.New("bytes left after last App message")
+
+// AppMessageIterator walks over the App messages carried in the payload of a Hub message
+type AppMessageIterator struct {
+	Remaining []byte // Bytes not decoded yet
+	Count     uint16 // App messages left, according to NumberOfAppPayloads
+	Err       error  // Why iteration stopped early, if it did
+}
+
+// InitAppMessageIterator starts iterating over the App messages of a decoded Hub message
+func InitAppMessageIterator(iterator *AppMessageIterator, hubData *HubCommData) {
+	iterator.Remaining = hubData.Payload
+	iterator.Count = hubData.NumberOfAppPayloads
+	iterator.Err = nil
+}
+
+// NextAppMessage decodes the next App message into appData. Returns false when there are no more
+// App messages, or when the rest of the Hub message is malformed, in which case iterator.Err says why.
+// appData.MasterBuffer refers to the Hub message, so it is only valid as long as the Hub message is.
+func NextAppMessage(iterator *AppMessageIterator, appData *AppCommData) bool {
+	if iterator.Err != nil {
+		return false
+	}
+	if iterator.Count == 0 {
+		if len(iterator.Remaining) > 0 {
+			iterator.Err = ErrTrailingBytes
+		}
+		return false
+	}
+	if len(iterator.Remaining) < AppHeaderSize {
+		iterator.Err = ErrShortFrame
+		return false
+	}
+	size := AppHeaderSize + int(binary.BigEndian.Uint16(iterator.Remaining[2:4]))
+	if size > len(iterator.Remaining) {
+		iterator.Err = ErrPayloadOverrun
+		return false
+	}
+	appData.MasterBuffer = iterator.Remaining[:size]
+	AppDecodeAppMessage(appData) // Already known to be well formed
+	iterator.Remaining = iterator.Remaining[size:]
+	iterator.Count--
+	return true
+}
@@ -0,0 +1,171 @@
+package gonetworktest
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testAppFrame makes an App message with the given ID, as it is carried in a Hub message
+func testAppFrame(ID uint64, payload string) []byte {
+	var appData AppCommData
+	InitAppMessage(&appData)
+	appData.ID = ID
+	appData.AppSequenceNumber = ID
+	appData.Payload = []byte(payload)
+	EncodeAppMessage(&appData)
+	return append([]byte(nil), appData.MasterBuffer...)
+}
+
+// testRawAppFrame makes an App message whose header gives payloadSize, followed by only present bytes
+// of payload
+func testRawAppFrame(payloadSize uint16, present int) []byte {
+	frame := make([]byte, AppHeaderSize+present)
+	binary.BigEndian.PutUint16(frame[2:4], payloadSize)
+	binary.BigEndian.PutUint64(frame[4:12], 1)
+	return frame
+}
+
+// testHubFrame makes a Hub message saying it holds count App messages, followed by the given bytes
+func testHubFrame(count uint16, appFrames ...[]byte) []byte {
+	frame := make([]byte, HubHeaderSize)
+	binary.BigEndian.PutUint64(frame[0:8], 7)
+	binary.BigEndian.PutUint64(frame[8:16], 3)
+	binary.BigEndian.PutUint16(frame[16:18], count)
+	for _, appFrame := range appFrames {
+		frame = append(frame, appFrame...)
+	}
+	return frame
+}
+
+// TestDecodeHubHeader decodes Hub messages whose App messages fill them exactly, or not
+func TestDecodeHubHeader(t *testing.T) {
+	first := testAppFrame(1, "first")
+	last := testAppFrame(2, "last")
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+		IDs   []uint64 // Of the App messages found by iterating, if the frame is good
+	}{
+		{"zero App messages", testHubFrame(0), nil, nil},
+		{"exact fit", testHubFrame(2, first, last), nil, []uint64{1, 2}},
+		{"last App message truncated", testHubFrame(2, first, last[:len(last)-1]), ErrPayloadOverrun, nil},
+		{"last App header truncated", testHubFrame(2, first, last[:AppHeaderSize-1]), ErrShortFrame, nil},
+		{"Hub header truncated", testHubFrame(0)[:HubHeaderSize-1], ErrShortFrame, nil},
+		{"empty", nil, ErrShortFrame, nil},
+		{"count too high", testHubFrame(3, first, last), ErrShortFrame, nil},
+		{"count too low", testHubFrame(1, first, last), ErrTrailingBytes, nil},
+		{"bytes without App messages", testHubFrame(0, first), ErrTrailingBytes, nil},
+		{"oversized payload size", testHubFrame(1, testRawAppFrame(0xffff, 10)), ErrPayloadOverrun, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hubData HubCommData
+			hubData.MasterBuffer = test.frame
+			err := DecodeHubHeader(&hubData)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Returned %v, expected %v", err, test.err)
+			}
+			// Decoding the whole Hub message fails the same way
+			var received HubCommData
+			InitHubMessage(&received)
+			received.MasterBuffer = test.frame
+			if _, err := DecodeHubMessage(&received); !errors.Is(err, test.err) {
+				t.Errorf("DecodeHubMessage returned %v, expected %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if hubData.SessionID != 7 || hubData.HubSequenceNumber != 3 {
+				t.Errorf("Decoded session %d and Hub sequence number %d, expected 7 and 3", hubData.SessionID, hubData.HubSequenceNumber)
+			}
+			var appMessages AppMessageIterator
+			var appData AppCommData
+			var IDs []uint64
+			InitAppMessageIterator(&appMessages, &hubData)
+			for NextAppMessage(&appMessages, &appData) {
+				IDs = append(IDs, appData.ID)
+			}
+			if appMessages.Err != nil || len(IDs) != len(test.IDs) {
+				t.Fatalf("Found App messages %v with error %v, expected %v", IDs, appMessages.Err, test.IDs)
+			}
+			for i := range IDs {
+				if IDs[i] != test.IDs[i] {
+					t.Errorf("Found App messages %v, expected %v", IDs, test.IDs)
+				}
+			}
+		})
+	}
+}
+
+// TestNextAppMessageErrors iterates over malformed Hub messages, and checks that the App messages
+// before the damage are found, and why iteration stopped
+func TestNextAppMessageErrors(t *testing.T) {
+	good := testAppFrame(1, "good")
+	tests := []struct {
+		name  string
+		count uint16
+		frame []byte // After the Hub header
+		found int
+		err   error
+	}{
+		{"header cut short", 2, append(append([]byte(nil), good...), good[:AppHeaderSize-1]...), 1, ErrShortFrame},
+		{"payload cut short", 2, append(append([]byte(nil), good...), good[:len(good)-1]...), 1, ErrPayloadOverrun},
+		{"oversized payload size", 1, testRawAppFrame(0xffff, 10), 0, ErrPayloadOverrun},
+		{"count too high", 2, good, 1, ErrShortFrame},
+		{"trailing bytes", 1, append(append([]byte(nil), good...), 0), 1, ErrTrailingBytes},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hubData HubCommData
+			hubData.NumberOfAppPayloads = test.count
+			hubData.Payload = test.frame
+			var appMessages AppMessageIterator
+			var appData AppCommData
+			InitAppMessageIterator(&appMessages, &hubData)
+			found := 0
+			for NextAppMessage(&appMessages, &appData) {
+				found++
+			}
+			if found != test.found || !errors.Is(appMessages.Err, test.err) {
+				t.Errorf("Found %d App messages with error %v, expected %d with %v", found, appMessages.Err, test.found, test.err)
+			}
+			if NextAppMessage(&appMessages, &appData) {
+				t.Error("Iteration went on after an error")
+			}
+		})
+	}
+}
+
+// TestDecodeAppMessageErrors decodes malformed App messages, as an App and as the Hub
+func TestDecodeAppMessageErrors(t *testing.T) {
+	good := testAppFrame(1, "good")
+	tests := []struct {
+		name   string
+		frame  []byte
+		appErr error // From AppDecodeAppMessage
+		hubErr error // From HubDecodeAppMessage
+	}{
+		{"good", good, nil, nil},
+		{"empty", nil, ErrShortFrame, ErrShortFrame},
+		{"header cut short", good[:AppHeaderSize-1], ErrShortFrame, ErrShortFrame},
+		{"payload cut short", good[:len(good)-1], ErrPayloadOverrun, ErrPayloadOverrun},
+		{"oversized payload size", testRawAppFrame(0xffff, 10), ErrPayloadOverrun, ErrPayloadOverrun},
+		{"too large for a Hub message", testRawAppFrame(0xffff, 0xffff), nil, ErrAppMessageTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var appData AppCommData
+			appData.MasterBuffer = test.frame
+			if err := AppDecodeAppMessage(&appData); !errors.Is(err, test.appErr) {
+				t.Errorf("AppDecodeAppMessage returned %v, expected %v", err, test.appErr)
+			}
+			expectedSequenceForApp := make(map[uint64]uint64)
+			appData.MasterBuffer = test.frame
+			if _, err := HubDecodeAppMessage(&appData, &expectedSequenceForApp); !errors.Is(err, test.hubErr) {
+				t.Errorf("HubDecodeAppMessage returned %v, expected %v", err, test.hubErr)
+			}
+		})
+	}
+}
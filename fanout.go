@@ -0,0 +1,96 @@
+package gonetworktest
+
+// Unicast fan-out, for networks without broadcast or multicast. Apps register with the Hub, and the
+// Hub sends every Hub message to each of them.
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+)
+
+// HubDefaultRegistrationTimeout is how long a registration with the Hub lasts, if not configured
+const HubDefaultRegistrationTimeout = 3 * time.Second
+
+// hubRegistration is where a registered App listens for Hub messages
+type hubRegistration struct {
+	address net.Addr
+	ID      uint64
+	expires time.Time
+}
+
+// hubFanOut sends Hub messages to every registered App, from the connection App messages arrive on
+type hubFanOut struct {
+	connection    net.PacketConn
+	timeout       time.Duration
+	registrations map[string]*hubRegistration
+	logger        *log.Logger
+}
+
+func initHubFanOut(fanOut *hubFanOut, connection net.PacketConn, timeout time.Duration, logger *log.Logger) {
+	fanOut.connection = connection
+	fanOut.timeout = timeout
+	fanOut.registrations = make(map[string]*hubRegistration)
+	fanOut.logger = logger
+}
+
+// hubRegistrationTimeout returns how long a registration with the Hub lasts
+func hubRegistrationTimeout(configuration Configuration) time.Duration {
+	timeout := time.Duration(configuration.HubRegistrationTimeoutMilliseconds) * time.Millisecond
+	if timeout <= 0 {
+		timeout = HubDefaultRegistrationTimeout
+	}
+	return timeout
+}
+
+// HubRegistrationInterval returns how often to register with the Hub, so that a registration or two
+// may be lost without it expiring
+func HubRegistrationInterval(configuration Configuration) time.Duration {
+	return hubRegistrationTimeout(configuration) / 3
+}
+
+// SendHubRegistration asks the Hub to send its Hub messages to where the connection listens, if the
+// Hub does unicast fan-out. It is sent from that connection, so the Hub sees the address to use.
+func SendHubRegistration(connection net.PacketConn, hubAddress net.Addr, ID uint64) error {
+	var data AppCommData
+	InitAppMessage(&data)
+	data.Type = MessageTypeHubRegistration
+	data.ID = ID
+	EncodeAppMessage(&data)
+	_, err := connection.WriteTo(data.MasterBuffer, hubAddress)
+	return err
+}
+
+// isHubRegistration tells if a frame received by the Hub is a registration, rather than an App message
+func isHubRegistration(frame []byte) bool {
+	return len(frame) >= AppHeaderSize && binary.BigEndian.Uint16(frame[0:2]) == MessageTypeHubRegistration
+}
+
+// registerWithFanOut adds or renews the registration of the address a registration came from
+func registerWithFanOut(fanOut *hubFanOut, frame []byte, address net.Addr) {
+	ID := binary.BigEndian.Uint64(frame[4:12])
+	key := address.String()
+	registration, ok := fanOut.registrations[key]
+	if !ok {
+		fanOut.logger.Print("Registered App ", ID, " at ", key)
+		registration = &hubRegistration{address: address}
+		fanOut.registrations[key] = registration
+	}
+	registration.ID = ID
+	registration.expires = time.Now().Add(fanOut.timeout)
+}
+
+// Write sends a Hub message to every registered App. Registrations that have expired are dropped
+// first. It never fails, since not every App may be reachable at any time, just as with broadcast.
+func (fanOut *hubFanOut) Write(frame []byte) (int, error) {
+	now := time.Now()
+	for key, registration := range fanOut.registrations {
+		if now.After(registration.expires) {
+			fanOut.logger.Print("Registration of App ", registration.ID, " at ", key, " expired")
+			delete(fanOut.registrations, key)
+			continue
+		}
+		fanOut.connection.WriteTo(frame, registration.address)
+	}
+	return len(frame), nil
+}
@@ -0,0 +1,237 @@
+package gonetworktest
+
+// A transport that misbehaves on purpose, the way UDP may, to show that Hubs, Apps and Gobs recover
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// FaultDefaultMaxDelay is the longest a datagram is delayed or held back for reordering, if not configured
+const FaultDefaultMaxDelay = 20 * time.Millisecond
+
+// FaultTransport wraps another transport, and drops, duplicates, reorders, delays and truncates
+// received datagrams, each with its own probability between 0 and 1. Faults are applied where
+// datagrams are received, so that every listener on a broadcast loses different datagrams, as with
+// real UDP. Streams are passed through untouched. Set the probabilities before opening connections.
+type FaultTransport struct {
+	Transport            Transport // The transport being wrapped
+	DropProbability      float64
+	DuplicateProbability float64
+	// A reordered datagram is held back until the datagram after it has been delivered, or until
+	// MaxDelay has passed. A delayed datagram is held back for a random time up to MaxDelay.
+	ReorderProbability  float64
+	DelayProbability    float64
+	MaxDelay            time.Duration
+	TruncateProbability float64
+	// Guards what follows, which is shared by all connections
+	mutex  sync.Mutex
+	random *rand.Rand
+	counts FaultCounts
+}
+
+// FaultCounts counts the faults a FaultTransport has injected
+type FaultCounts struct {
+	Received   int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Delayed    int
+	Truncated  int
+}
+
+// faultDatagram is a datagram held back by a faultPacketConn. It is delivered once due has passed,
+// or, if afterNext is set, once a later datagram has been delivered.
+type faultDatagram struct {
+	payload   []byte
+	source    net.Addr
+	due       time.Time
+	afterNext bool
+}
+
+// faultPacketConn injects faults into the datagrams read from a packet connection. Like the
+// connections it wraps, it is meant to be read from one goroutine at a time.
+type faultPacketConn struct {
+	net.PacketConn
+	transport     *FaultTransport
+	receiveBuffer []byte
+	held          []faultDatagram
+	mutex         sync.Mutex
+	readDeadline  time.Time
+}
+
+// InitFaultTransport initializes a fault injecting transport around another transport, with the
+// probabilities and seed from the configuration. If FaultSeed is zero, a seed is picked and logged,
+// so a run can be repeated.
+func InitFaultTransport(transport *FaultTransport, inner Transport, configuration Configuration) {
+	transport.Transport = inner
+	transport.DropProbability = configuration.FaultDropProbability
+	transport.DuplicateProbability = configuration.FaultDuplicateProbability
+	transport.ReorderProbability = configuration.FaultReorderProbability
+	transport.DelayProbability = configuration.FaultDelayProbability
+	transport.MaxDelay = time.Duration(configuration.FaultMaxDelayMilliseconds) * time.Millisecond
+	if transport.MaxDelay <= 0 {
+		transport.MaxDelay = FaultDefaultMaxDelay
+	}
+	transport.TruncateProbability = configuration.FaultTruncateProbability
+	seed := configuration.FaultSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+		log.Print("Injecting faults with seed ", seed)
+	}
+	transport.random = rand.New(rand.NewSource(seed))
+	transport.counts = FaultCounts{}
+}
+
+// ConfiguredTransport returns the transport the configuration asks for: UDPTransport with the
+// multicast settings, wrapped in a FaultTransport if any fault probability is set
+func ConfiguredTransport(configuration Configuration) Transport {
+	if configuration.FaultDropProbability <= 0 && configuration.FaultDuplicateProbability <= 0 &&
+		configuration.FaultReorderProbability <= 0 && configuration.FaultDelayProbability <= 0 &&
+		configuration.FaultTruncateProbability <= 0 {
+		return configuredUDPTransport(configuration)
+	}
+	transport := &FaultTransport{}
+	InitFaultTransport(transport, configuredUDPTransport(configuration), configuration)
+	return transport
+}
+
+// FaultTransportCounts returns how many faults have been injected so far
+func FaultTransportCounts(transport *FaultTransport) FaultCounts {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.counts
+}
+
+// ListenPacket listens for datagrams with the wrapped transport, and injects faults into them
+func (transport *FaultTransport) ListenPacket(address string) (net.PacketConn, error) {
+	pc, err := transport.Transport.ListenPacket(address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultPacketConn{PacketConn: pc, transport: transport, receiveBuffer: make([]byte, BufferAllocationSize)}, nil
+}
+
+// DialPacket is passed through, since the datagrams it sends get their faults where they are received
+func (transport *FaultTransport) DialPacket(address string) (net.Conn, error) {
+	return transport.Transport.DialPacket(address)
+}
+
+// ListenStream is passed through, since streams don't lose or reorder anything
+func (transport *FaultTransport) ListenStream(address string) (net.Listener, error) {
+	return transport.Transport.ListenStream(address)
+}
+
+// DialStream is passed through, since streams don't lose or reorder anything
+func (transport *FaultTransport) DialStream(address string) (net.Conn, error) {
+	return transport.Transport.DialStream(address)
+}
+
+// faultHappens rolls the dice for a fault with the given probability, and counts it if it happens
+func faultHappens(transport *FaultTransport, probability float64, count *int) bool {
+	if probability <= 0 || transport.random.Float64() >= probability {
+		return false
+	}
+	*count++
+	return true
+}
+
+// ReadFrom returns the next datagram, after deciding what faults it gets. Held back datagrams are
+// returned when they are due.
+func (conn *faultPacketConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	transport := conn.transport
+	for {
+		if n, address, ok := nextHeldDatagram(conn, buffer); ok {
+			return n, address, nil
+		}
+		// Wake up in time for the next held back datagram
+		conn.mutex.Lock()
+		deadline := conn.readDeadline
+		conn.mutex.Unlock()
+		wake := deadline
+		for _, datagram := range conn.held {
+			if wake.IsZero() || datagram.due.Before(wake) {
+				wake = datagram.due
+			}
+		}
+		conn.PacketConn.SetReadDeadline(wake)
+		frameSize, address, err := conn.PacketConn.ReadFrom(conn.receiveBuffer)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && (deadline.IsZero() || time.Now().Before(deadline)) {
+				continue // Woke up for a held back datagram
+			}
+			return 0, nil, err
+		}
+
+		transport.mutex.Lock()
+		transport.counts.Received++
+		if faultHappens(transport, transport.DropProbability, &transport.counts.Dropped) {
+			transport.mutex.Unlock()
+			continue
+		}
+		if faultHappens(transport, transport.TruncateProbability, &transport.counts.Truncated) {
+			frameSize = transport.random.Intn(frameSize + 1)
+		}
+		payload := conn.receiveBuffer[:frameSize]
+		now := time.Now()
+		if faultHappens(transport, transport.DuplicateProbability, &transport.counts.Duplicated) {
+			conn.held = append(conn.held, faultDatagram{payload: append([]byte(nil), payload...), source: address, due: now})
+		}
+		if faultHappens(transport, transport.ReorderProbability, &transport.counts.Reordered) {
+			conn.held = append(conn.held, faultDatagram{payload: append([]byte(nil), payload...), source: address, due: now.Add(transport.MaxDelay), afterNext: true})
+			transport.mutex.Unlock()
+			continue
+		}
+		if faultHappens(transport, transport.DelayProbability, &transport.counts.Delayed) {
+			delay := time.Duration(transport.random.Int63n(int64(transport.MaxDelay) + 1))
+			conn.held = append(conn.held, faultDatagram{payload: append([]byte(nil), payload...), source: address, due: now.Add(delay)})
+			transport.mutex.Unlock()
+			continue
+		}
+		transport.mutex.Unlock()
+
+		// Datagrams held back for reordering go right after this one
+		for i := range conn.held {
+			if conn.held[i].afterNext {
+				conn.held[i].afterNext = false
+				conn.held[i].due = now
+			}
+		}
+		return copy(buffer, payload), address, nil
+	}
+}
+
+// nextHeldDatagram returns the held back datagram that has been due the longest, if any is due
+func nextHeldDatagram(conn *faultPacketConn, buffer []byte) (int, net.Addr, bool) {
+	now := time.Now()
+	next := -1
+	for i, datagram := range conn.held {
+		if !datagram.due.After(now) && (next < 0 || datagram.due.Before(conn.held[next].due)) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return 0, nil, false
+	}
+	datagram := conn.held[next]
+	conn.held = append(conn.held[:next], conn.held[next+1:]...)
+	return copy(buffer, datagram.payload), datagram.source, true
+}
+
+// SetDeadline sets the read deadline of the fault injection, and the write deadline of the connection
+func (conn *faultPacketConn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.PacketConn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline applies to reads started after it is set
+func (conn *faultPacketConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = t
+	return nil
+}
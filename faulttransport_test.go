@@ -0,0 +1,159 @@
+package gonetworktest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// faultTestDatagrams is how many datagrams each fault test sends
+const faultTestDatagrams = 10000
+
+// receiveWithFaults sends datagrams numbered from 0 over a MemoryTransport, and returns the numbers
+// in the order they are received through a FaultTransport, with the faults it counted
+func receiveWithFaults(t *testing.T, configuration Configuration) ([]uint32, FaultCounts) {
+	var memory MemoryTransport
+	InitMemoryTransport(&memory)
+	memory.QueueLength = faultTestDatagrams
+	var faults FaultTransport
+	InitFaultTransport(&faults, &memory, configuration)
+	pc, err := faults.ListenPacket(":7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	connection, err := memory.DialPacket(":7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	datagram := make([]byte, 4)
+	for i := uint32(0); i < faultTestDatagrams; i++ {
+		binary.BigEndian.PutUint32(datagram, i)
+		if _, err := connection.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []uint32
+	buffer := make([]byte, BufferAllocationSize)
+	for {
+		// Long enough for anything held back to come out
+		pc.SetReadDeadline(time.Now().Add(faults.MaxDelay + 100*time.Millisecond))
+		n, _, err := pc.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		if n != len(datagram) {
+			t.Fatalf("Received a datagram of %d bytes, expected %d", n, len(datagram))
+		}
+		received = append(received, binary.BigEndian.Uint32(buffer[:n]))
+	}
+	return received, FaultTransportCounts(&faults)
+}
+
+// checkFaultRate checks that a fault was injected about as often as its probability says. The
+// limit is five standard deviations, which a fixed seed stays well within.
+func checkFaultRate(t *testing.T, name string, count int, probability float64) {
+	expected := probability * faultTestDatagrams
+	if limit := 5 * math.Sqrt(expected*(1-probability)); math.Abs(float64(count)-expected) > limit {
+		t.Errorf("%s %d datagrams, expected %.0f±%.0f", name, count, expected, limit)
+	}
+}
+
+// countLateDatagrams counts the datagrams received after one with a higher number
+func countLateDatagrams(received []uint32) int {
+	late := 0
+	var highest uint32
+	for i, number := range received {
+		if i > 0 && number < highest {
+			late++
+		}
+		if number > highest {
+			highest = number
+		}
+	}
+	return late
+}
+
+// TestFaultTransportSeed checks that faults injected with the same seed are the same every time
+func TestFaultTransportSeed(t *testing.T) {
+	configuration := Configuration{
+		FaultDropProbability:      0.1,
+		FaultDuplicateProbability: 0.1,
+		FaultReorderProbability:   0.1,
+		FaultSeed:                 42,
+	}
+	first, firstCounts := receiveWithFaults(t, configuration)
+	second, secondCounts := receiveWithFaults(t, configuration)
+	if firstCounts != secondCounts {
+		t.Errorf("Injected %+v and then %+v with the same seed", firstCounts, secondCounts)
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Error("Received different datagrams with the same seed")
+	}
+	configuration.FaultSeed = 43
+	if other, _ := receiveWithFaults(t, configuration); fmt.Sprint(first) == fmt.Sprint(other) {
+		t.Error("Received the same datagrams with another seed")
+	}
+}
+
+// TestFaultTransportRates injects each kind of fault on its own, and checks that it happens about
+// as often as configured, and does what it should to the datagrams
+func TestFaultTransportRates(t *testing.T) {
+	const probability = 0.1
+	t.Run("drop", func(t *testing.T) {
+		received, counts := receiveWithFaults(t, Configuration{FaultDropProbability: probability, FaultSeed: 1})
+		checkFaultRate(t, "Dropped", counts.Dropped, probability)
+		if len(received) != faultTestDatagrams-counts.Dropped {
+			t.Errorf("Received %d datagrams, expected %d", len(received), faultTestDatagrams-counts.Dropped)
+		}
+		for i := 1; i < len(received); i++ {
+			if received[i] <= received[i-1] {
+				t.Fatalf("Received datagram %d after %d", received[i], received[i-1])
+			}
+		}
+	})
+	t.Run("duplicate", func(t *testing.T) {
+		received, counts := receiveWithFaults(t, Configuration{FaultDuplicateProbability: probability, FaultSeed: 2})
+		checkFaultRate(t, "Duplicated", counts.Duplicated, probability)
+		times := make(map[uint32]int)
+		twice := 0
+		for _, number := range received {
+			times[number]++
+			if times[number] == 2 {
+				twice++
+			}
+		}
+		if len(times) != faultTestDatagrams || twice != counts.Duplicated || len(received) != faultTestDatagrams+twice {
+			t.Errorf("Received %d datagrams, %d of them twice, expected %d with %d twice", len(times), twice, faultTestDatagrams, counts.Duplicated)
+		}
+	})
+	t.Run("reorder", func(t *testing.T) {
+		received, counts := receiveWithFaults(t, Configuration{FaultReorderProbability: probability, FaultSeed: 3})
+		checkFaultRate(t, "Reordered", counts.Reordered, probability)
+		// Every reordered datagram comes after one sent later than it, and no other does
+		late := countLateDatagrams(received)
+		if len(received) != faultTestDatagrams || late != counts.Reordered {
+			t.Errorf("Received %d datagrams, %d of them late, expected %d with %d late", len(received), late, faultTestDatagrams, counts.Reordered)
+		}
+	})
+	t.Run("delay", func(t *testing.T) {
+		received, counts := receiveWithFaults(t, Configuration{FaultDelayProbability: probability, FaultMaxDelayMilliseconds: 50, FaultSeed: 4})
+		checkFaultRate(t, "Delayed", counts.Delayed, probability)
+		seen := make(map[uint32]bool)
+		for _, number := range received {
+			seen[number] = true
+		}
+		if len(received) != faultTestDatagrams || len(seen) != faultTestDatagrams {
+			t.Errorf("Received %d datagrams, %d different, expected %d", len(received), len(seen), faultTestDatagrams)
+		}
+		// Only delayed datagrams come after ones sent later, and some of them are held back long
+		// enough to do so
+		if late := countLateDatagrams(received); late == 0 || late > counts.Delayed {
+			t.Errorf("Received %d datagrams late, expected between 1 and %d", late, counts.Delayed)
+		}
+	})
+}
@@ -0,0 +1,326 @@
+package gonetworktest
+
+// Functions for talking to the Gob service
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// GobRequestSize is the size in bytes of an encoded Gob request
+const GobRequestSize = 24
+
+// GobReplyHeaderSize is the size in bytes of the header in front of every datagram sent from a Gob
+const GobReplyHeaderSize = 2
+
+// GobReplyHubMessage marks a Gob reply carrying a raw Hub message that is being sent again
+const GobReplyHubMessage uint16 = 1
+
+// GobReplyTCPOffer marks a Gob reply telling the App to fetch the requested range over TCP instead.
+// The body is the original request followed by the TCP port of the Gob.
+const GobReplyTCPOffer uint16 = 2
+
+// GobTCPOfferSize is the size in bytes of the body of a TCP offer
+const GobTCPOfferSize = GobRequestSize + 2
+
+// GobMaxUDPReplyRange is the largest number of Hub messages a Gob sends again over UDP. Larger
+// ranges are streamed over TCP.
+const GobMaxUDPReplyRange = 256
+
+// GobLatestSession can be used as SessionID in a request, to ask for the most recent session the Gob knows of
+const GobLatestSession uint64 = 0xffffffffffffffff
+
+// GobCatchUpTimeout is how long an App waits for a Gob to answer when catching up at startup
+const GobCatchUpTimeout = 2 * time.Second
+
+// GobStreamHeaderSize is the size in bytes of the length in front of every Hub message streamed over TCP
+const GobStreamHeaderSize = 2
+
+// GobRequestData is for handling requests from an App to a Gob, asking for Hub messages to be sent again
+type GobRequestData struct {
+	// Actual data as native data types
+	SessionID    uint64
+	FromSequence uint64 // First Hub sequence number wanted
+	ToSequence   uint64 // Last Hub sequence number wanted, inclusive
+	// Temporary buffer storage for data
+	SessionIDBuffer    []byte
+	FromSequenceBuffer []byte
+	ToSequenceBuffer   []byte
+	// The actual data as bytes that will be sent over UDP
+	MasterBuffer []byte
+}
+
+// InitGobRequest initializes all the request parameters
+func InitGobRequest(data *GobRequestData) {
+	data.SessionID = 0
+	data.FromSequence = 0
+	data.ToSequence = 0
+	data.SessionIDBuffer = make([]byte, 8)
+	data.FromSequenceBuffer = make([]byte, 8)
+	data.ToSequenceBuffer = make([]byte, 8)
+	data.MasterBuffer = make([]byte, 0, GobRequestSize)
+}
+
+// EncodeGobRequest encodes the request fields as bytes in the master buffer
+func EncodeGobRequest(data *GobRequestData) {
+	data.MasterBuffer = data.MasterBuffer[:0] // Clear the byte slice send buffer
+
+	binary.BigEndian.PutUint64(data.SessionIDBuffer, data.SessionID)
+	binary.BigEndian.PutUint64(data.FromSequenceBuffer, data.FromSequence)
+	binary.BigEndian.PutUint64(data.ToSequenceBuffer, data.ToSequence)
+
+	data.MasterBuffer = append(data.MasterBuffer, data.SessionIDBuffer...)
+	data.MasterBuffer = append(data.MasterBuffer, data.FromSequenceBuffer...)
+	data.MasterBuffer = append(data.MasterBuffer, data.ToSequenceBuffer...)
+}
+
+// SendGobRequest encodes as bytes and sends a Gob request to the given address
+func SendGobRequest(data *GobRequestData, connection net.PacketConn, address net.Addr) {
+	EncodeGobRequest(data)
+	connection.WriteTo(data.MasterBuffer, address)
+}
+
+// DecodeGobRequest decodes the bytes in a request to a Gob
+func DecodeGobRequest(data *GobRequestData) bool {
+	if len(data.MasterBuffer) < GobRequestSize {
+		return false
+	}
+	data.SessionID = binary.BigEndian.Uint64(data.MasterBuffer[0:8])
+	data.FromSequence = binary.BigEndian.Uint64(data.MasterBuffer[8:16])
+	data.ToSequence = binary.BigEndian.Uint64(data.MasterBuffer[16:24])
+	return data.FromSequence <= data.ToSequence
+}
+
+// ReceiveHubFrames reads Hub messages from a connection, and passes a copy of each one on to a
+// channel. Returns when the connection is closed, or when done is closed.
+func ReceiveHubFrames(pc net.PacketConn, frames chan []byte, done <-chan struct{}) {
+	receiveBuffer := make([]byte, BufferAllocationSize)
+	for {
+		frameSize, _, err := pc.ReadFrom(receiveBuffer)
+		if err != nil {
+			return
+		}
+		frame := make([]byte, frameSize)
+		copy(frame, receiveBuffer[:frameSize])
+		if !passFrame(frames, frame, done) {
+			return
+		}
+	}
+}
+
+// passFrame passes a frame on to a channel, unless done is closed first. Returns false if it is,
+// so that nothing is left blocked on a channel nobody reads any more.
+func passFrame(frames chan []byte, frame []byte, done <-chan struct{}) bool {
+	select {
+	case frames <- frame:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// SendGobReply sends a reply of the given type from a Gob to an App, using buffer as scratch space
+func SendGobReply(replyType uint16, body []byte, buffer []byte, connection net.PacketConn, address net.Addr) ([]byte, error) {
+	buffer = buffer[:GobReplyHeaderSize]
+	binary.BigEndian.PutUint16(buffer, replyType)
+	buffer = append(buffer, body...)
+	_, err := connection.WriteTo(buffer, address)
+	return buffer, err
+}
+
+// SendGobTCPOffer tells an App to fetch the requested range over TCP from the given port
+func SendGobTCPOffer(request *GobRequestData, port int, connection net.PacketConn, address net.Addr) error {
+	EncodeGobRequest(request)
+	body := make([]byte, GobTCPOfferSize)
+	copy(body, request.MasterBuffer)
+	binary.BigEndian.PutUint16(body[GobRequestSize:], uint16(port))
+	_, err := SendGobReply(GobReplyTCPOffer, body, make([]byte, 0, GobReplyHeaderSize+GobTCPOfferSize), connection, address)
+	return err
+}
+
+// ReceiveGobReplies reads replies from a Gob, and passes a copy of each Hub message in them on to a
+// channel. When the Gob offers TCP, the Hub messages are fetched from there instead, over the
+// transport. Returns when the connection is closed, or when done is closed.
+func ReceiveGobReplies(transport Transport, pc net.PacketConn, frames chan []byte, done <-chan struct{}) {
+	receiveBuffer := make([]byte, BufferAllocationSize)
+	for {
+		frameSize, address, err := pc.ReadFrom(receiveBuffer)
+		if err != nil {
+			return
+		}
+		if frameSize < GobReplyHeaderSize {
+			continue
+		}
+		body := receiveBuffer[GobReplyHeaderSize:frameSize]
+		switch binary.BigEndian.Uint16(receiveBuffer[0:GobReplyHeaderSize]) {
+		case GobReplyHubMessage:
+			frame := make([]byte, len(body))
+			copy(frame, body)
+			if !passFrame(frames, frame, done) {
+				return
+			}
+		case GobReplyTCPOffer:
+			request, tcpAddress, ok := decodeGobTCPOffer(body, address)
+			if !ok {
+				continue
+			}
+			go FetchGobMessages(transport, tcpAddress, &request, frames, done)
+		}
+	}
+}
+
+// decodeGobTCPOffer finds the request and the TCP address to fetch it from, in a TCP offer from a Gob
+func decodeGobTCPOffer(body []byte, address net.Addr) (GobRequestData, string, bool) {
+	var request GobRequestData
+	InitGobRequest(&request)
+	if len(body) < GobTCPOfferSize {
+		return request, "", false
+	}
+	request.MasterBuffer = append(request.MasterBuffer, body[:GobRequestSize]...)
+	if !DecodeGobRequest(&request) {
+		return request, "", false
+	}
+	udpAddress, ok := address.(*net.UDPAddr)
+	if !ok {
+		return request, "", false
+	}
+	port := binary.BigEndian.Uint16(body[GobRequestSize:GobTCPOfferSize])
+	// A link-local IPv6 address is only usable with the interface it was seen on
+	host := udpAddress.IP.String()
+	if udpAddress.Zone != "" {
+		host += "%" + udpAddress.Zone
+	}
+	return request, net.JoinHostPort(host, strconv.Itoa(int(port))), true
+}
+
+// CatchUpFromGob fetches the whole history of the latest session from a Gob over TCP, and passes each
+// Hub message on to a channel. Returns when the Gob has sent everything it has, or with an error if
+// no Gob answered within GobCatchUpTimeout, or when done is closed.
+func CatchUpFromGob(transport Transport, configuration Configuration, frames chan []byte, done <-chan struct{}) error {
+	gobAddress, err := net.ResolveUDPAddr("udp", configuration.AppGobRiseAddress)
+	if err != nil {
+		return err
+	}
+	connection, err := transport.ListenPacket(":0")
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	var request GobRequestData
+	InitGobRequest(&request)
+	request.SessionID = GobLatestSession
+	request.FromSequence = 0
+	request.ToSequence = 0xffffffffffffffff
+	SendGobRequest(&request, connection, gobAddress)
+
+	// A request this large is always answered with a TCP offer
+	connection.SetReadDeadline(time.Now().Add(GobCatchUpTimeout))
+	receiveBuffer := make([]byte, BufferAllocationSize)
+	for {
+		frameSize, address, err := connection.ReadFrom(receiveBuffer)
+		if err != nil {
+			return err
+		}
+		if frameSize < GobReplyHeaderSize || binary.BigEndian.Uint16(receiveBuffer[0:GobReplyHeaderSize]) != GobReplyTCPOffer {
+			continue
+		}
+		offered, tcpAddress, ok := decodeGobTCPOffer(receiveBuffer[GobReplyHeaderSize:frameSize], address)
+		if !ok {
+			continue
+		}
+		return FetchGobMessages(transport, tcpAddress, &offered, frames, done)
+	}
+}
+
+// FetchGobMessages connects to a Gob over TCP, asks for a range of Hub messages, and passes each
+// Hub message on to a channel until the Gob closes the connection. Closing done stops it early.
+func FetchGobMessages(transport Transport, address string, request *GobRequestData, frames chan []byte, done <-chan struct{}) error {
+	connection, err := transport.DialStream(address)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			connection.Close() // Wakes up a read waiting for the Gob
+		case <-finished:
+		}
+	}()
+	EncodeGobRequest(request)
+	if _, err = connection.Write(request.MasterBuffer); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(connection)
+	for {
+		frame, err := ReadGobStream(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !passFrame(frames, frame, done) {
+			return nil
+		}
+	}
+}
+
+// WriteGobStream writes a Hub message to a TCP stream, prefixed by its length
+func WriteGobStream(writer io.Writer, frame []byte) error {
+	header := make([]byte, GobStreamHeaderSize)
+	binary.BigEndian.PutUint16(header, uint16(len(frame)))
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(frame)
+	return err
+}
+
+// ReadGobStream reads a Hub message written by WriteGobStream. Returns io.EOF when the stream
+// ends cleanly between messages.
+func ReadGobStream(reader io.Reader) ([]byte, error) {
+	header := make([]byte, GobStreamHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ConnectGobRequests sets up a connection for asking a Gob for missing Hub messages on behalf of
+// the Hub data. Hub messages sent from the Gob in reply are passed on to the frames channel, until
+// the connection or done is closed.
+func ConnectGobRequests(transport Transport, configuration Configuration, data *HubCommData, frames chan []byte, done <-chan struct{}) (net.PacketConn, error) {
+	gobAddress, err := net.ResolveUDPAddr("udp", configuration.AppGobRiseAddress)
+	if err != nil {
+		return nil, err
+	}
+	// Not connected to the Gob address, since replies come from the Gob host itself
+	connection, err := transport.ListenPacket(":0")
+	if err != nil {
+		return nil, err
+	}
+	var request GobRequestData
+	InitGobRequest(&request)
+	data.RequestGap = func(sessionID uint64, fromSequence uint64, toSequence uint64) {
+		request.SessionID = sessionID
+		request.FromSequence = fromSequence
+		request.ToSequence = toSequence
+		SendGobRequest(&request, connection, gobAddress)
+	}
+	go ReceiveGobReplies(transport, connection, frames, done)
+	return connection, nil
+}
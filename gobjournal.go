@@ -0,0 +1,315 @@
+package gonetworktest
+
+// Append-only on-disk journal of Hub messages, so the Gob history survives a restart
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Journal sync policies, set by GobJournalSyncPolicy
+const (
+	syncAlways   = "always"   // fsync after every Hub message
+	syncInterval = "interval" // fsync every GobJournalSyncMilliseconds
+	syncNever    = "never"    // leave it to the operating system
+)
+
+// Defaults used for journal settings that are left out of the configuration
+const (
+	defaultJournalSyncPolicy       = syncInterval
+	defaultJournalSyncMilliseconds = 1000
+	defaultJournalSegmentBytes     = 64 * 1024 * 1024
+)
+
+// journalSuffix is the file name ending of journal segment files
+const journalSuffix = ".journal"
+
+// journalRecordHeaderSize is the size of the length and CRC-32 in front of every journalled Hub message
+const journalRecordHeaderSize = 6
+
+// journalSegment is one file of the journal. Segments are numbered in the order they were created.
+type journalSegment struct {
+	number   uint64
+	path     string
+	size     int64
+	modified time.Time
+	// Hub sequence numbers held in the segment, per session. Hub messages arriving late are held by
+	// the segment they were written to, so the ranges may have holes between them.
+	sessions map[uint64][]sequenceRange
+}
+
+type gobJournal struct {
+	directory      string
+	syncPolicy     string
+	syncInterval   time.Duration
+	segmentBytes   int64
+	retentionAge   time.Duration
+	retentionBytes int64
+	segments       []*journalSegment // Oldest first. The last one is written to.
+	file           *os.File
+	writer         *bufio.Writer
+	header         []byte
+	unsynced       bool
+	logger         *log.Logger
+}
+
+// openGobJournal opens the journal in the configured directory, and loads the Hub messages already
+// in it into the Gob store. A record torn by a crash at the end of the journal is cut off.
+func openGobJournal(configuration Configuration, gobStorage *gobStore, logger *log.Logger) (*gobJournal, error) {
+	journal := &gobJournal{
+		directory:      configuration.GobJournalDirectory,
+		syncPolicy:     configuration.GobJournalSyncPolicy,
+		syncInterval:   time.Duration(configuration.GobJournalSyncMilliseconds) * time.Millisecond,
+		segmentBytes:   configuration.GobJournalSegmentBytes,
+		retentionAge:   time.Duration(configuration.GobJournalRetentionSeconds) * time.Second,
+		retentionBytes: configuration.GobJournalRetentionBytes,
+		header:         make([]byte, journalRecordHeaderSize),
+		logger:         logger,
+	}
+	if journal.syncPolicy == "" {
+		journal.syncPolicy = defaultJournalSyncPolicy
+	}
+	if journal.syncPolicy != syncAlways && journal.syncPolicy != syncInterval && journal.syncPolicy != syncNever {
+		return nil, fmt.Errorf("unknown journal sync policy %q", journal.syncPolicy)
+	}
+	if journal.syncInterval <= 0 {
+		journal.syncInterval = defaultJournalSyncMilliseconds * time.Millisecond
+	}
+	if journal.segmentBytes <= 0 {
+		journal.segmentBytes = defaultJournalSegmentBytes
+	}
+	if err := os.MkdirAll(journal.directory, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := findJournalSegments(journal.directory)
+	if err != nil {
+		return nil, err
+	}
+	for index, segment := range segments {
+		last := index == len(segments)-1
+		if err := replayJournalSegment(segment, gobStorage, last, logger); err != nil {
+			return nil, err
+		}
+	}
+	journal.segments = segments
+
+	if len(segments) == 0 {
+		err = rollGobJournal(journal)
+	} else {
+		err = openJournalSegment(journal, segments[len(segments)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Print("Loaded ", len(segments), " journal segments from ", journal.directory)
+	return journal, nil
+}
+
+// findJournalSegments lists the segment files in a directory, oldest first
+func findJournalSegments(directory string) ([]*journalSegment, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]*journalSegment, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), journalSuffix) {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), journalSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &journalSegment{
+			number:   number,
+			path:     filepath.Join(directory, file.Name()),
+			size:     file.Size(),
+			modified: file.ModTime(),
+			sessions: make(map[uint64][]sequenceRange),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].number < segments[j].number })
+	return segments, nil
+}
+
+// replayJournalSegment stores every intact record of a segment in the Gob store. If the segment is
+// the last one, anything after the last intact record is truncated, so appending can continue.
+func replayJournalSegment(segment *journalSegment, gobStorage *gobStore, last bool, logger *log.Logger) error {
+	file, err := os.OpenFile(segment.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, journalRecordHeaderSize)
+	var goodSize int64
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(header[0:2]))
+		if _, err = io.ReadFull(reader, frame); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(frame) != binary.BigEndian.Uint32(header[2:6]) {
+			err = fmt.Errorf("checksum mismatch at offset %d", goodSize)
+			break
+		}
+		goodSize += int64(journalRecordHeaderSize + len(frame))
+		if storeHubMessage(gobStorage, frame) == nil {
+			addToJournalSegment(segment, frame)
+		}
+	}
+	if err == io.EOF && goodSize == segment.size {
+		return nil
+	}
+	logger.Print("Journal segment ", segment.path, " is damaged after ", goodSize, " bytes: ", err)
+	if !last {
+		return nil
+	}
+	segment.size = goodSize
+	return file.Truncate(goodSize)
+}
+
+// addToJournalSegment notes that a segment holds a Hub message
+func addToJournalSegment(segment *journalSegment, frame []byte) {
+	sessionID := binary.BigEndian.Uint64(frame[0:8])
+	sequence := binary.BigEndian.Uint64(frame[8:16])
+	held := segment.sessions[sessionID]
+	if last := len(held) - 1; last >= 0 && sequence == held[last].to+1 {
+		held[last].to = sequence
+	} else {
+		held = append(held, sequenceRange{from: sequence, to: sequence})
+	}
+	segment.sessions[sessionID] = held
+}
+
+func openJournalSegment(journal *gobJournal, segment *journalSegment) error {
+	file, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	journal.file = file
+	journal.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// rollGobJournal closes the segment being written to, and starts a new one
+func rollGobJournal(journal *gobJournal) error {
+	var number uint64
+	if len(journal.segments) > 0 {
+		number = journal.segments[len(journal.segments)-1].number + 1
+	}
+	if journal.file != nil {
+		if err := closeGobJournal(journal); err != nil {
+			return err
+		}
+	}
+	segment := &journalSegment{
+		number:   number,
+		path:     filepath.Join(journal.directory, fmt.Sprintf("%020d%s", number, journalSuffix)),
+		modified: time.Now(),
+		sessions: make(map[uint64][]sequenceRange),
+	}
+	if err := openJournalSegment(journal, segment); err != nil {
+		return err
+	}
+	journal.segments = append(journal.segments, segment)
+	return nil
+}
+
+// appendGobJournal writes a Hub message to the end of the journal
+func appendGobJournal(journal *gobJournal, frame []byte) error {
+	segment := journal.segments[len(journal.segments)-1]
+	if segment.size > 0 && segment.size+int64(journalRecordHeaderSize+len(frame)) > journal.segmentBytes {
+		if err := rollGobJournal(journal); err != nil {
+			return err
+		}
+		segment = journal.segments[len(journal.segments)-1]
+	}
+
+	binary.BigEndian.PutUint16(journal.header[0:2], uint16(len(frame)))
+	binary.BigEndian.PutUint32(journal.header[2:6], crc32.ChecksumIEEE(frame))
+	if _, err := journal.writer.Write(journal.header); err != nil {
+		return err
+	}
+	if _, err := journal.writer.Write(frame); err != nil {
+		return err
+	}
+	segment.size += int64(journalRecordHeaderSize + len(frame))
+	segment.modified = time.Now()
+	addToJournalSegment(segment, frame)
+	journal.unsynced = true
+
+	if journal.syncPolicy == syncAlways {
+		return syncGobJournal(journal)
+	}
+	return nil
+}
+
+// syncGobJournal writes buffered Hub messages to the segment file, and unless the sync policy is
+// "never", makes sure they are on disk
+func syncGobJournal(journal *gobJournal) error {
+	if !journal.unsynced {
+		return nil
+	}
+	if err := journal.writer.Flush(); err != nil {
+		return err
+	}
+	journal.unsynced = false
+	if journal.syncPolicy == syncNever {
+		return nil
+	}
+	return journal.file.Sync()
+}
+
+// closeGobJournal syncs and closes the segment being written to
+func closeGobJournal(journal *gobJournal) error {
+	journal.unsynced = true
+	if err := syncGobJournal(journal); err != nil {
+		return err
+	}
+	return journal.file.Close()
+}
+
+// enforceJournalRetention deletes the oldest segments when they are older than the retention age, or
+// when the journal is larger than the retention size. Their Hub messages are forgotten by the Gob
+// store too. The segment being written to is never deleted.
+func enforceJournalRetention(journal *gobJournal, gobStorage *gobStore) {
+	var totalBytes int64
+	for _, segment := range journal.segments {
+		totalBytes += segment.size
+	}
+	for len(journal.segments) > 1 {
+		oldest := journal.segments[0]
+		tooOld := journal.retentionAge > 0 && time.Since(oldest.modified) > journal.retentionAge
+		tooLarge := journal.retentionBytes > 0 && totalBytes > journal.retentionBytes
+		if !tooOld && !tooLarge {
+			return
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			journal.logger.Print("Could not delete journal segment: ", err)
+			return
+		}
+		journal.logger.Print("Deleted journal segment ", oldest.path)
+		for sessionID, held := range oldest.sessions {
+			for _, sequences := range held {
+				forgetHubMessages(gobStorage, sessionID, sequences.from, sequences.to)
+			}
+		}
+		totalBytes -= oldest.size
+		journal.segments = journal.segments[1:]
+	}
+}
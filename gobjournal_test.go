@@ -0,0 +1,157 @@
+package gonetworktest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// testHubMessage makes a Hub message holding a single App message
+func testHubMessage(sessionID uint64, sequence uint64) []byte {
+	var appData AppCommData
+	InitAppMessage(&appData)
+	appData.ID = 1
+	appData.AppSequenceNumber = sequence
+	appData.Payload = []byte("payload")
+	EncodeAppMessage(&appData)
+	var hubData HubCommData
+	InitHubMessage(&hubData)
+	hubData.SessionID = sessionID
+	hubData.HubSequenceNumber = sequence
+	var frame bytes.Buffer
+	SendHubMessage(&appData, &hubData, &frame)
+	return frame.Bytes()
+}
+
+// TestJournalRetentionKeepsLateHubMessages deletes a journal segment, and checks that a Hub message
+// that arrived late, and was written to a newer segment, is still there
+func TestJournalRetentionKeepsLateHubMessages(t *testing.T) {
+	const sessionID = 7
+	logger := log.New(io.Discard, "", 0)
+	configuration := Configuration{GobJournalDirectory: t.TempDir()}
+	var gobStorage gobStore
+	initGobStore(&gobStorage)
+	journal, err := openGobJournal(configuration, &gobStorage, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(sequence uint64) {
+		frame := testHubMessage(sessionID, sequence)
+		if err := storeHubMessage(&gobStorage, frame); err != nil {
+			t.Fatal("Could not store Hub message ", sequence, ": ", err)
+		}
+		if err := appendGobJournal(journal, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Hub message 5 is lost at first, and arrives after the next segment has been started
+	for sequence := uint64(0); sequence < 10; sequence++ {
+		if sequence != 5 {
+			write(sequence)
+		}
+	}
+	if err := rollGobJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	for sequence := uint64(10); sequence < 20; sequence++ {
+		write(sequence)
+	}
+	write(5)
+	if err := closeGobJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+
+	// What is held by each segment is found again when the journal is loaded
+	initGobStore(&gobStorage)
+	journal, err = openGobJournal(configuration, &gobStorage, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeGobJournal(journal)
+	journal.retentionBytes = journal.segments[1].size
+	enforceJournalRetention(journal, &gobStorage)
+	if len(journal.segments) != 1 {
+		t.Fatalf("Got %d journal segments, expected 1", len(journal.segments))
+	}
+	for sequence := uint64(0); sequence < 20; sequence++ {
+		_, found := lookupHubMessage(&gobStorage, sessionID, sequence)
+		expected := sequence == 5 || sequence >= 10
+		if found != expected {
+			t.Errorf("Hub message %d found: %v, expected %v", sequence, found, expected)
+		}
+	}
+}
+
+// TestJournalTornTail damages the last record of a journal segment, as a crash while writing it
+// would, and checks that loading the journal keeps the complete records, and cuts off the rest
+func TestJournalTornTail(t *testing.T) {
+	const sessionID = 7
+	const records = 5
+	tests := []struct {
+		name   string
+		damage func(data []byte, goodSize int) []byte
+	}{
+		{"record cut short", func(data []byte, goodSize int) []byte { return data[:len(data)-3] }},
+		{"header cut short", func(data []byte, goodSize int) []byte { return data[:goodSize+2] }},
+		{"checksum mismatch", func(data []byte, goodSize int) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := log.New(io.Discard, "", 0)
+			configuration := Configuration{GobJournalDirectory: t.TempDir()}
+			var gobStorage gobStore
+			initGobStore(&gobStorage)
+			journal, err := openGobJournal(configuration, &gobStorage, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goodSize := 0
+			for sequence := uint64(0); sequence < records; sequence++ {
+				frame := testHubMessage(sessionID, sequence)
+				if sequence < records-1 {
+					goodSize += journalRecordHeaderSize + len(frame)
+				}
+				if err := appendGobJournal(journal, frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := journal.segments[len(journal.segments)-1].path
+			if err := closeGobJournal(journal); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, test.damage(data, goodSize), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			initGobStore(&gobStorage)
+			journal, err = openGobJournal(configuration, &gobStorage, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeGobJournal(journal)
+			for sequence := uint64(0); sequence < records; sequence++ {
+				_, found := lookupHubMessage(&gobStorage, sessionID, sequence)
+				if expected := sequence < records-1; found != expected {
+					t.Errorf("Hub message %d found: %v, expected %v", sequence, found, expected)
+				}
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(goodSize) {
+				t.Errorf("Journal segment is %d bytes, expected %d", info.Size(), goodSize)
+			}
+		})
+	}
+}
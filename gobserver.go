@@ -0,0 +1,106 @@
+package gonetworktest
+
+// Answers requests from Apps for Hub messages to be sent again, over UDP or by streaming over TCP
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// gobRequestReadTimeout is how long a TCP client gets to send its request after connecting
+const gobRequestReadTimeout = 5 * time.Second
+
+// gobQuery asks the main loop for the stored Hub messages of a session within a range of sequence numbers
+type gobQuery struct {
+	sessionID    uint64
+	fromSequence uint64
+	toSequence   uint64
+	reply        chan [][]byte
+}
+
+// queryGobStore returns nothing if the Gob stops before answering
+func queryGobStore(ctx context.Context, queries chan gobQuery, sessionID uint64, fromSequence uint64, toSequence uint64) [][]byte {
+	query := gobQuery{sessionID: sessionID, fromSequence: fromSequence, toSequence: toSequence, reply: make(chan [][]byte, 1)}
+	select {
+	case queries <- query:
+		return <-query.reply
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// receiveGobRequests answers small ranges directly over UDP, and offers TCP for large ones
+func receiveGobRequests(ctx context.Context, pc net.PacketConn, queries chan gobQuery, tcpPort int, logger *log.Logger) {
+	var request GobRequestData
+	InitGobRequest(&request)
+	receiveBuffer := make([]byte, BufferAllocationSize)
+	replyBuffer := make([]byte, 0, BufferAllocationSize)
+
+	for {
+		frameSize, address, err := pc.ReadFrom(receiveBuffer)
+		if err != nil {
+			logger.Print("Stopped receiving Gob requests: ", err)
+			return
+		}
+		request.MasterBuffer = receiveBuffer[0:frameSize]
+		if !DecodeGobRequest(&request) {
+			continue
+		}
+		logger.Print("UDP request for session ", request.SessionID, " sequence ", request.FromSequence, "-", request.ToSequence, " from ", address)
+
+		if request.ToSequence-request.FromSequence >= GobMaxUDPReplyRange {
+			if err := SendGobTCPOffer(&request, tcpPort, pc, address); err != nil {
+				logger.Print("Could not send TCP offer: ", err)
+			}
+			continue
+		}
+		for _, frame := range queryGobStore(ctx, queries, request.SessionID, request.FromSequence, request.ToSequence) {
+			replyBuffer, err = SendGobReply(GobReplyHubMessage, frame, replyBuffer, pc, address)
+			if err != nil {
+				logger.Print("Could not send Gob reply: ", err)
+				break
+			}
+		}
+	}
+}
+
+// serveGobStreams accepts TCP connections from Apps until the listener is closed
+func serveGobStreams(ctx context.Context, listener net.Listener, queries chan gobQuery, logger *log.Logger) {
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			logger.Print("Stopped accepting Gob streams: ", err)
+			return
+		}
+		go serveGobStream(ctx, connection, queries, logger)
+	}
+}
+
+func serveGobStream(ctx context.Context, connection net.Conn, queries chan gobQuery, logger *log.Logger) {
+	defer connection.Close()
+
+	// Every connection starts with a Gob request, and ends when the range has been sent
+	var request GobRequestData
+	InitGobRequest(&request)
+	request.MasterBuffer = request.MasterBuffer[0:GobRequestSize]
+	connection.SetReadDeadline(time.Now().Add(gobRequestReadTimeout))
+	if _, err := io.ReadFull(connection, request.MasterBuffer); err != nil {
+		return
+	}
+	if !DecodeGobRequest(&request) {
+		return
+	}
+	logger.Print("TCP request for session ", request.SessionID, " sequence ", request.FromSequence, "-", request.ToSequence, " from ", connection.RemoteAddr())
+
+	frames := queryGobStore(ctx, queries, request.SessionID, request.FromSequence, request.ToSequence)
+	writer := bufio.NewWriter(connection)
+	for _, frame := range frames {
+		if err := WriteGobStream(writer, frame); err != nil {
+			return
+		}
+	}
+	writer.Flush()
+}
@@ -0,0 +1,177 @@
+package gonetworktest
+
+// Gob records Hub messages, and sends them again to Apps that ask for them, so it can be run inside any program
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// gobHoleReportInterval is how often a Gob reports Hub messages missing from its own history
+const gobHoleReportInterval = 5 * time.Second
+
+// gobRetentionCheckInterval is how often old journal segments are looked for
+const gobRetentionCheckInterval = time.Minute
+
+// Gob listens to the Hub broadcast, and answers requests from Apps for the Hub messages it has
+// heard. Set the fields before running it.
+type Gob struct {
+	Configuration Configuration
+	Transport     Transport
+	Logger        *log.Logger
+}
+
+// InitGob initializes a Gob from the configuration
+func InitGob(gob *Gob, configuration Configuration) {
+	gob.Configuration = configuration
+	// No faults are injected here, even if configured, since nobody fills the gaps of a Gob
+	gob.Transport = configuredUDPTransport(configuration)
+	gob.Logger = log.New(os.Stderr, "", log.LstdFlags)
+}
+
+// WaitForGob waits until a Gob takes stream connections, which is the last thing it sets up, so that
+// it hears every Hub message of a Hub started after it. Returns the error of the last try if the
+// timeout passes first.
+func WaitForGob(transport Transport, configuration Configuration, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		connection, err := transport.DialStream(configuration.GobTCPAddress)
+		if err == nil {
+			return connection.Close()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// RunGob runs a Gob until the context is done, and then returns nil. If GobJournalDirectory is set,
+// the history is loaded from the journal first, and every Hub message heard is added to it. Returns
+// an error if the Gob couldn't start, or the journal couldn't be written.
+func RunGob(ctx context.Context, gob *Gob) error {
+	configuration := gob.Configuration
+	logger := gob.Logger
+	if err := ValidateConfiguration(configuration); err != nil {
+		return err
+	}
+
+	var gobStorage gobStore
+	initGobStore(&gobStorage)
+
+	// Reload history from the journal, if there is one
+	var journal *gobJournal
+	var journalSyncTick, retentionTick <-chan time.Time // Never fire without a journal
+	if configuration.GobJournalDirectory != "" {
+		var err error
+		journal, err = openGobJournal(configuration, &gobStorage, logger)
+		if err != nil {
+			return err
+		}
+		defer closeGobJournal(journal)
+		enforceJournalRetention(journal, &gobStorage)
+		journalSyncTicker := time.NewTicker(journal.syncInterval)
+		defer journalSyncTicker.Stop()
+		journalSyncTick = journalSyncTicker.C
+		retentionTicker := time.NewTicker(gobRetentionCheckInterval)
+		defer retentionTicker.Stop()
+		retentionTick = retentionTicker.C
+	}
+
+	// Listen to the Hub broadcast
+	pc, err := gob.Transport.ListenPacket(configuration.AppSinkAddress)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	// Listen to requests from Apps, answered over UDP or by streaming over TCP
+	requestConnection, err := gob.Transport.ListenPacket(configuration.GobSinkAddress)
+	if err != nil {
+		return err
+	}
+	defer requestConnection.Close()
+	listener, err := gob.Transport.ListenStream(configuration.GobTCPAddress)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	queries := make(chan gobQuery, 128)
+	go serveGobStreams(ctx, listener, queries, logger)
+	go receiveGobRequests(ctx, requestConnection, queries, listener.Addr().(*net.TCPAddr).Port, logger)
+
+	// Initialize channel for receiving. Every Hub message is kept, whatever order it arrives in.
+	frames := make(chan []byte, 128)
+	go ReceiveHubFrames(pc, frames, ctx.Done())
+
+	holeTicker := time.NewTicker(gobHoleReportInterval)
+	defer holeTicker.Stop()
+
+	// A Hub doing unicast fan-out only sends to those who register, the Gob as much as any App
+	var hubAddress net.Addr
+	var registrationTick <-chan time.Time // Never fires without unicast fan-out
+	if configuration.HubUnicastFanOut {
+		hubAddress, err = net.ResolveUDPAddr("udp", configuration.AppRiseAddress)
+		if err != nil {
+			return err
+		}
+		registerGob(pc, hubAddress, logger)
+		registrationTicker := time.NewTicker(HubRegistrationInterval(configuration))
+		defer registrationTicker.Stop()
+		registrationTick = registrationTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Print("Stopped Gob at session ", gobStorage.lastSession)
+			return nil
+		// Store raw incoming Hub messages, to answer Gob calls
+		case frame := <-frames:
+			if isHubHeartbeat(frame) {
+				continue
+			}
+			previousSession := gobStorage.lastSession
+			if err := storeHubMessage(&gobStorage, frame); err != nil {
+				logger.Print("Ignored Hub message of ", len(frame), " bytes: ", err)
+				continue
+			}
+			if journal != nil {
+				if err := appendGobJournal(journal, frame); err != nil {
+					return err
+				}
+			}
+			if gobStorage.lastSession != previousSession {
+				logger.Print("Session changed from ", previousSession, " to ", gobStorage.lastSession)
+			}
+		// Look up stored Hub messages for Apps that ask for them
+		case query := <-queries:
+			if query.sessionID == GobLatestSession {
+				query.sessionID = gobStorage.lastSession
+			}
+			query.reply <- lookupHubMessageRange(&gobStorage, query.sessionID, query.fromSequence, query.toSequence)
+		case <-journalSyncTick:
+			if err := syncGobJournal(journal); err != nil {
+				return err
+			}
+		case <-retentionTick:
+			enforceJournalRetention(journal, &gobStorage)
+		case <-registrationTick:
+			registerGob(pc, hubAddress, logger)
+		case <-holeTicker.C:
+			for _, hole := range findHoles(&gobStorage, gobStorage.lastSession) {
+				logger.Print("Missing from history of session ", gobStorage.lastSession, ": sequence ", hole.from, "-", hole.to)
+			}
+		}
+	}
+}
+
+// registerGob asks the Hub to keep sending Hub messages to where the Gob listens. A Gob has no App
+// ID, so it registers as 0.
+func registerGob(pc net.PacketConn, hubAddress net.Addr, logger *log.Logger) {
+	if err := SendHubRegistration(pc, hubAddress, 0); err != nil {
+		logger.Print("Could not register with Hub: ", err)
+	}
+}
@@ -0,0 +1,195 @@
+package gonetworktest
+
+// In-memory history of Hub messages, indexed by SessionID and HubSequenceNumber
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// initialSessionCapacity is the number of Hub messages we make room for when a new session starts
+const initialSessionCapacity = 1024
+
+// maxSequenceJump limits how far outside the stored range a Hub sequence number may be, so a bogus
+// sequence number can't make us allocate all memory
+const maxSequenceJump = 1 << 20
+
+// errDuplicateHubMessage is returned when a Hub message is already in the history
+var errDuplicateHubMessage = errors.New("duplicate")
+
+// errSequenceJump is returned when a Hub sequence number is more than maxSequenceJump away from the
+// Hub messages stored for its session
+var errSequenceJump = errors.New("sequence jump too far from the stored Hub messages")
+
+// gobSession holds the Hub messages of one session. frames[i] is the message with Hub sequence number
+// firstSequence+i, or nil if it hasn't been received.
+type gobSession struct {
+	firstSequence uint64
+	frames        [][]byte
+	stored        uint64 // Number of non-nil entries in frames
+	duplicates    uint64 // Number of messages received more than once
+}
+
+type gobStore struct {
+	data        map[uint64]*gobSession
+	lastSession uint64 // Latest session seen
+}
+
+// sequenceRange is an inclusive range of Hub sequence numbers
+type sequenceRange struct {
+	from uint64
+	to   uint64
+}
+
+func initGobStore(gobStorage *gobStore) {
+	gobStorage.data = make(map[uint64]*gobSession)
+	gobStorage.lastSession = 0
+}
+
+// isHubHeartbeat tells if a Hub message is a heartbeat. Heartbeats carry no App messages, and don't
+// use up a Hub sequence number, so they aren't kept.
+func isHubHeartbeat(frame []byte) bool {
+	return len(frame) >= HubHeaderSize && binary.BigEndian.Uint16(frame[16:18]) == 0
+}
+
+// storeHubMessage keeps a Hub message in the history. The frame is kept as is, so the caller must
+// not reuse it. Returns an error if the message was a duplicate, malformed, or too far from the rest
+// of its session.
+func storeHubMessage(gobStorage *gobStore, frame []byte) error {
+	var hubData HubCommData
+	hubData.MasterBuffer = frame
+	if err := DecodeHubHeader(&hubData); err != nil {
+		return err
+	}
+	sessionID := hubData.SessionID
+	sequence := hubData.HubSequenceNumber
+
+	session, ok := gobStorage.data[sessionID]
+	if !ok {
+		session = &gobSession{firstSequence: sequence, frames: make([][]byte, 0, initialSessionCapacity)}
+		gobStorage.data[sessionID] = session
+	}
+	// Session IDs only ever go up, so the highest one is the latest session
+	if sessionID > gobStorage.lastSession {
+		gobStorage.lastSession = sessionID
+	}
+
+	// Measured from the lowest and highest Hub messages stored
+	if sequence < session.firstSequence && session.firstSequence-sequence > maxSequenceJump {
+		return errSequenceJump
+	}
+	if highest := session.firstSequence + uint64(len(session.frames)) - 1; len(session.frames) > 0 && sequence > highest && sequence-highest > maxSequenceJump {
+		return errSequenceJump
+	}
+	if sequence < session.firstSequence {
+		// Arrived late, so make room in front of what we already have
+		grown := make([][]byte, session.firstSequence-sequence, uint64(len(session.frames))+session.firstSequence-sequence)
+		session.frames = append(grown, session.frames...)
+		session.firstSequence = sequence
+	}
+	index := sequence - session.firstSequence
+	for uint64(len(session.frames)) <= index {
+		session.frames = append(session.frames, nil)
+	}
+	if session.frames[index] != nil {
+		session.duplicates++
+		return errDuplicateHubMessage
+	}
+	session.frames[index] = frame
+	session.stored++
+	return nil
+}
+
+// lookupHubMessage finds a single stored Hub message
+func lookupHubMessage(gobStorage *gobStore, sessionID uint64, sequence uint64) ([]byte, bool) {
+	session, ok := gobStorage.data[sessionID]
+	if !ok || sequence < session.firstSequence || sequence-session.firstSequence >= uint64(len(session.frames)) {
+		return nil, false
+	}
+	frame := session.frames[sequence-session.firstSequence]
+	return frame, frame != nil
+}
+
+// lookupHubMessageRange finds the stored Hub messages of a session within an inclusive range of
+// sequence numbers, in sequence order. Messages missing from the history are left out.
+func lookupHubMessageRange(gobStorage *gobStore, sessionID uint64, fromSequence uint64, toSequence uint64) [][]byte {
+	frames := make([][]byte, 0)
+	session, ok := gobStorage.data[sessionID]
+	if !ok || toSequence < session.firstSequence || fromSequence > toSequence {
+		return frames
+	}
+	if fromSequence < session.firstSequence {
+		fromSequence = session.firstSequence
+	}
+	last := session.firstSequence + uint64(len(session.frames)) - 1
+	if toSequence > last {
+		toSequence = last
+	}
+	for sequence := fromSequence; sequence <= toSequence && sequence >= fromSequence; sequence++ {
+		if frame := session.frames[sequence-session.firstSequence]; frame != nil {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// lastSequence returns the highest Hub sequence number stored for a session
+func lastSequence(gobStorage *gobStore, sessionID uint64) (uint64, bool) {
+	session, ok := gobStorage.data[sessionID]
+	if !ok || len(session.frames) == 0 {
+		return 0, false
+	}
+	return session.firstSequence + uint64(len(session.frames)) - 1, true
+}
+
+// findHoles lists the ranges of Hub sequence numbers missing from the history of a session
+func findHoles(gobStorage *gobStore, sessionID uint64) []sequenceRange {
+	holes := make([]sequenceRange, 0)
+	session, ok := gobStorage.data[sessionID]
+	if !ok || session.stored == uint64(len(session.frames)) {
+		return holes
+	}
+	inHole := false
+	for index, frame := range session.frames {
+		sequence := session.firstSequence + uint64(index)
+		if frame == nil && !inHole {
+			holes = append(holes, sequenceRange{from: sequence, to: sequence})
+			inHole = true
+		} else if frame == nil {
+			holes[len(holes)-1].to = sequence
+		} else {
+			inHole = false
+		}
+	}
+	return holes
+}
+
+// forgetHubMessages removes the Hub messages of a session within an inclusive range of sequence
+// numbers from the history. A session with nothing left is removed altogether.
+func forgetHubMessages(gobStorage *gobStore, sessionID uint64, fromSequence uint64, toSequence uint64) {
+	session, ok := gobStorage.data[sessionID]
+	if !ok {
+		return
+	}
+	for sequence := fromSequence; sequence <= toSequence && sequence >= fromSequence; sequence++ {
+		if sequence < session.firstSequence {
+			continue
+		}
+		index := sequence - session.firstSequence
+		if index >= uint64(len(session.frames)) {
+			break
+		}
+		if session.frames[index] != nil {
+			session.frames[index] = nil
+			session.stored--
+		}
+	}
+	if session.stored == 0 {
+		delete(gobStorage.data, sessionID)
+		return
+	}
+	// Drop what has been forgotten from the front, so it isn't reported as a hole
+	for session.frames[0] == nil {
+		session.frames = session.frames[1:]
+		session.firstSequence++
+	}
+}
@@ -0,0 +1,89 @@
+package gonetworktest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestStoreHubMessage stores Hub messages, and looks them up again
+func TestStoreHubMessage(t *testing.T) {
+	type store struct {
+		sessionID uint64
+		sequence  uint64
+		size      int // Cut the frame down to this size, if not 0
+		err       error
+	}
+	tests := []struct {
+		name        string
+		stores      []store
+		stored      map[uint64][]uint64 // Hub sequence numbers found for each session
+		lastSession uint64
+	}{
+		{"in order", []store{{7, 0, 0, nil}, {7, 1, 0, nil}, {7, 2, 0, nil}},
+			map[uint64][]uint64{7: {0, 1, 2}}, 7},
+		{"out of order", []store{{7, 5, 0, nil}, {7, 3, 0, nil}, {7, 4, 0, nil}, {7, 0, 0, nil}},
+			map[uint64][]uint64{7: {0, 3, 4, 5}}, 7},
+		{"duplicate", []store{{7, 0, 0, nil}, {7, 1, 0, nil}, {7, 0, 0, errDuplicateHubMessage}},
+			map[uint64][]uint64{7: {0, 1}}, 7},
+		{"malformed", []store{{7, 0, 10, ErrShortFrame}, {7, 1, 44, ErrPayloadOverrun}, {7, 2, 0, nil}},
+			map[uint64][]uint64{7: {2}}, 7},
+		{"jump from highest", []store{
+			{7, 0, 0, nil},
+			{7, maxSequenceJump, 0, nil},
+			{7, 2*maxSequenceJump + 1, 0, errSequenceJump},
+			{7, maxSequenceJump + 1, 0, nil},
+			{7, 2*maxSequenceJump + 1, 0, nil},
+		}, map[uint64][]uint64{7: {0, maxSequenceJump, maxSequenceJump + 1, 2*maxSequenceJump + 1}}, 7},
+		{"jump from lowest", []store{
+			{7, 2 * maxSequenceJump, 0, nil},
+			{7, maxSequenceJump - 1, 0, errSequenceJump},
+			{7, maxSequenceJump, 0, nil},
+		}, map[uint64][]uint64{7: {maxSequenceJump, 2 * maxSequenceJump}}, 7},
+		{"sessions", []store{{7, 0, 0, nil}, {9, 0, 0, nil}, {8, 5, 0, nil}, {7, 1, 0, nil}},
+			map[uint64][]uint64{7: {0, 1}, 8: {5}, 9: {0}}, 9},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gobStorage gobStore
+			initGobStore(&gobStorage)
+			for _, store := range test.stores {
+				frame := testHubMessage(store.sessionID, store.sequence)
+				if store.size != 0 {
+					frame = frame[:store.size]
+				}
+				if err := storeHubMessage(&gobStorage, frame); !errors.Is(err, store.err) {
+					t.Errorf("Storing Hub message %d of session %d returned %v, expected %v", store.sequence, store.sessionID, err, store.err)
+				}
+			}
+			if gobStorage.lastSession != test.lastSession {
+				t.Errorf("Latest session is %d, expected %d", gobStorage.lastSession, test.lastSession)
+			}
+			if len(gobStorage.data) != len(test.stored) {
+				t.Errorf("Got %d sessions, expected %d", len(gobStorage.data), len(test.stored))
+			}
+			for sessionID, sequences := range test.stored {
+				var found []uint64
+				for _, frame := range lookupHubMessageRange(&gobStorage, sessionID, 0, ^uint64(0)) {
+					found = append(found, binary.BigEndian.Uint64(frame[8:16]))
+				}
+				if fmt.Sprint(found) != fmt.Sprint(sequences) {
+					t.Errorf("Found Hub messages %v of session %d, expected %v", found, sessionID, sequences)
+				}
+				for _, sequence := range sequences {
+					frame, ok := lookupHubMessage(&gobStorage, sessionID, sequence)
+					if !ok || binary.BigEndian.Uint64(frame[0:8]) != sessionID || binary.BigEndian.Uint64(frame[8:16]) != sequence {
+						t.Errorf("Hub message %d of session %d not found", sequence, sessionID)
+					}
+				}
+				if last, _ := lastSequence(&gobStorage, sessionID); last != sequences[len(sequences)-1] {
+					t.Errorf("Last Hub message of session %d is %d, expected %d", sessionID, last, sequences[len(sequences)-1])
+				}
+			}
+			if _, ok := lookupHubMessage(&gobStorage, 6, 0); ok {
+				t.Error("Found a Hub message of a session never stored")
+			}
+		})
+	}
+}
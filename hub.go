@@ -0,0 +1,241 @@
+package gonetworktest
+
+// Hub sequences App messages into Hub messages, so it can be run inside any program
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// HubDefaultCheckpointInterval is how often a Hub checkpoints, if not configured
+const HubDefaultCheckpointInterval = time.Second
+
+// hubFlushRetryInterval is how long a Hub waits before sending a Hub message again, when it
+// couldn't be sent
+const hubFlushRetryInterval = 10 * time.Millisecond
+
+// Hub receives App messages, and sends the ones that are next in sequence for their App on to the
+// Apps, packed together in Hub messages. Set the fields before running it.
+type Hub struct {
+	SinkAddress string // Where App messages arrive
+	RiseAddress string // Where Hub messages are sent, unless UnicastFanOut is set
+	// UnicastFanOut sends Hub messages to every App that has registered within RegistrationTimeout.
+	// App messages aren't sequenced until the Hub has run for RegistrationTimeout, so that everyone
+	// listening, the Gob included, has registered again after a restart.
+	UnicastFanOut       bool
+	RegistrationTimeout time.Duration
+	// Hub messages are at most MaxDatagramSize bytes, and App messages wait at most Linger for more
+	// to arrive. No waiting if zero.
+	MaxDatagramSize int
+	Linger          time.Duration
+	// A heartbeat is sent when there has been nothing else to send for HeartbeatInterval
+	HeartbeatInterval time.Duration
+	// SessionID of the Hub messages. If zero, a new one is made with NewSessionID and SessionFile.
+	SessionID   uint64
+	SessionFile string
+	// PreviousSessionID and PreviousHubSequenceNumber tell where the session before this one ended,
+	// if known. The first Hub message of the session announces them, so that Apps can fetch what
+	// they missed of the previous session before going on with this one.
+	PreviousSessionID         uint64
+	PreviousHubSequenceNumber uint64 // Next Hub sequence number of the previous session
+	// ExpectedSequenceForApp holds the next App sequence number to accept from each App. It may be
+	// filled in before running, for example from a checkpoint.
+	ExpectedSequenceForApp map[uint64]uint64
+	// Checkpoint, if set, is called every CheckpointInterval while App messages are arriving, and
+	// when the Hub stops. It is only called when every accepted App message has been sent.
+	Checkpoint         func(sessionID uint64, hubSequenceNumber uint64, expectedSequenceForApp map[uint64]uint64) error
+	CheckpointInterval time.Duration
+	Transport          Transport
+	Logger             *log.Logger
+}
+
+// InitHub initializes a Hub from the configuration
+func InitHub(hub *Hub, configuration Configuration) {
+	hub.SinkAddress = configuration.HubSinkAddress
+	hub.RiseAddress = configuration.HubRiseAddress
+	hub.UnicastFanOut = configuration.HubUnicastFanOut
+	hub.RegistrationTimeout = hubRegistrationTimeout(configuration)
+	hub.MaxDatagramSize = configuration.HubMaxDatagramSize
+	if hub.MaxDatagramSize <= 0 || hub.MaxDatagramSize > BufferAllocationSize {
+		hub.MaxDatagramSize = HubDefaultMaxDatagramSize
+	}
+	hub.Linger = time.Duration(configuration.HubMaxLingerMicroseconds) * time.Microsecond
+	hub.HeartbeatInterval = time.Duration(configuration.HubHeartbeatMilliseconds) * time.Millisecond
+	if hub.HeartbeatInterval <= 0 {
+		hub.HeartbeatInterval = HubDefaultHeartbeatMilliseconds * time.Millisecond
+	}
+	hub.SessionID = 0
+	hub.SessionFile = configuration.HubSessionFile
+	hub.PreviousSessionID = 0
+	hub.PreviousHubSequenceNumber = 0
+	hub.ExpectedSequenceForApp = make(map[uint64]uint64)
+	hub.Checkpoint = nil
+	hub.CheckpointInterval = time.Duration(configuration.HubCheckpointMilliseconds) * time.Millisecond
+	if hub.CheckpointInterval <= 0 {
+		hub.CheckpointInterval = HubDefaultCheckpointInterval
+	}
+	hub.Transport = ConfiguredTransport(configuration)
+	hub.Logger = log.New(os.Stderr, "", log.LstdFlags)
+}
+
+// RunHub runs a Hub until the context is done. The App messages already accepted are then sent,
+// and a last checkpoint is made, before it returns nil. Returns an error if the Hub couldn't start.
+func RunHub(ctx context.Context, hub *Hub) error {
+	if hub.SessionID == 0 {
+		sessionID, err := NewSessionID(hub.SessionFile)
+		if err != nil {
+			return err
+		}
+		hub.SessionID = sessionID
+	}
+	if hub.ExpectedSequenceForApp == nil {
+		hub.ExpectedSequenceForApp = make(map[uint64]uint64)
+	}
+
+	// Listen to incoming App messages, and registrations
+	pc, err := hub.Transport.ListenPacket(hub.SinkAddress)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	// Hub messages go to the rise address, or to each registered App
+	var connection io.Writer
+	var fanOut *hubFanOut
+	var registeringUntil time.Time
+	if hub.UnicastFanOut {
+		fanOut = &hubFanOut{}
+		initHubFanOut(fanOut, pc, hub.RegistrationTimeout, hub.Logger)
+		connection = fanOut
+		registeringUntil = time.Now().Add(hub.RegistrationTimeout)
+		hub.Logger.Print("Sending Hub messages to registered Apps, and waiting ", hub.RegistrationTimeout, " for them to register")
+	} else {
+		riseConnection, err := hub.Transport.DialPacket(hub.RiseAddress)
+		if err != nil {
+			return err
+		}
+		defer riseConnection.Close()
+		connection = riseConnection
+	}
+
+	var hubData HubCommData
+	InitHubMessage(&hubData)
+	hubData.SessionID = hub.SessionID
+	hub.Logger.Print("Starting Hub session ", hubData.SessionID)
+	var sinkData AppCommData
+	InitAppMessage(&sinkData)
+	receiveBuffer := sinkData.MasterBuffer[0:BufferAllocationSize] // Allocate receive buffer
+	rejectedFrames := 0
+	var batchStarted time.Time
+	var flushRetry time.Time // No flushing before then, after a Hub message couldn't be sent
+	var lastSent time.Time   // A heartbeat goes out at once, so standby Hubs know about us
+	lastCheckpoint := time.Now()
+	checkpointPending := hub.Checkpoint != nil
+	announcing := true // The session starts with where the previous one ended
+
+	for ctx.Err() == nil {
+		// Once everyone listening has registered, if they have to
+		if announcing && !time.Now().Before(registeringUntil) {
+			var announcement AppCommData
+			InitAppMessage(&announcement)
+			EncodeSessionAnnouncement(&announcement, hub.PreviousSessionID, hub.PreviousHubSequenceNumber)
+			AppendHubMessage(&announcement, &hubData)
+			batchStarted = time.Now()
+			announcing = false
+		}
+		// Don't wait for more App messages than the linger time allows, or past the next heartbeat
+		// or checkpoint
+		var deadline time.Time
+		if hubData.NumberOfAppPayloads > 0 {
+			deadline = batchStarted.Add(hub.Linger)
+			if deadline.Before(flushRetry) {
+				deadline = flushRetry
+			}
+		} else {
+			deadline = lastSent.Add(hub.HeartbeatInterval)
+			if checkpointPending && lastCheckpoint.Add(hub.CheckpointInterval).Before(deadline) {
+				deadline = lastCheckpoint.Add(hub.CheckpointInterval)
+			}
+		}
+		pc.SetReadDeadline(deadline)
+		frameSize, source, err := pc.ReadFrom(receiveBuffer)
+		if err == nil && isHubRegistration(receiveBuffer[0:frameSize]) {
+			if fanOut != nil {
+				registerWithFanOut(fanOut, receiveBuffer[0:frameSize], source)
+			}
+		} else if err == nil && time.Now().Before(registeringUntil) {
+			// Too early to sequence anything, since not everyone may have registered yet. The App
+			// sends it again.
+		} else if err == nil {
+			sinkData.MasterBuffer = receiveBuffer[0:frameSize]
+			// Only send a Hub message if App message is valid
+			ok, err := HubDecodeAppMessage(&sinkData, &hub.ExpectedSequenceForApp)
+			if err != nil {
+				rejectedFrames++
+				hub.Logger.Print("Rejected App message number ", rejectedFrames, ": ", err)
+			}
+			// Send what we have first, if the App message doesn't fit. If that fails, the App
+			// message isn't accepted after all, and the App sends it again.
+			if ok && hubData.NumberOfAppPayloads > 0 && HubMessageSize(&sinkData, &hubData) > hub.MaxDatagramSize {
+				if flushHub(hub, &hubData, connection, &flushRetry) {
+					lastSent = time.Now()
+				} else {
+					hub.ExpectedSequenceForApp[sinkData.ID] = sinkData.AppSequenceNumber
+					ok = false
+				}
+			}
+			if ok {
+				if hubData.NumberOfAppPayloads == 0 {
+					batchStarted = time.Now()
+				}
+				AppendHubMessage(&sinkData, &hubData)
+				checkpointPending = hub.Checkpoint != nil
+			}
+		}
+		if hubData.NumberOfAppPayloads > 0 && !time.Now().Before(flushRetry) && (hub.Linger == 0 || hubData.NumberOfAppPayloads == 0xffff || !time.Now().Before(batchStarted.Add(hub.Linger))) {
+			if flushHub(hub, &hubData, connection, &flushRetry) {
+				lastSent = time.Now()
+			}
+		}
+		if hubData.NumberOfAppPayloads == 0 && time.Since(lastSent) >= hub.HeartbeatInterval {
+			SendHubHeartbeat(&hubData, connection)
+			lastSent = time.Now()
+		}
+		// Only checkpoint what has actually been sent
+		if checkpointPending && hubData.NumberOfAppPayloads == 0 && time.Since(lastCheckpoint) >= hub.CheckpointInterval {
+			checkpointHub(hub, &hubData)
+			lastCheckpoint = time.Now()
+			checkpointPending = false
+		}
+	}
+
+	// Don't leave accepted App messages behind. If they can't be sent, the last checkpoint has to do,
+	// so that the Apps can send them to the next Hub. A last heartbeat tells where the session ended.
+	if flushHub(hub, &hubData, connection, &flushRetry) {
+		SendHubHeartbeat(&hubData, connection)
+		if checkpointPending {
+			checkpointHub(hub, &hubData)
+		}
+	}
+	hub.Logger.Print("Stopped Hub session ", hubData.SessionID, " at Hub sequence number ", hubData.HubSequenceNumber)
+	return nil
+}
+
+// flushHub sends the Hub message being put together. If it can't be sent, it is kept, and not sent
+// again before hubFlushRetryInterval has passed. Returns false if it couldn't be sent.
+func flushHub(hub *Hub, hubData *HubCommData, connection io.Writer, flushRetry *time.Time) bool {
+	if err := FlushHubMessage(hubData, connection); err != nil {
+		hub.Logger.Print("Could not send Hub message ", hubData.HubSequenceNumber, ": ", err)
+		*flushRetry = time.Now().Add(hubFlushRetryInterval)
+		return false
+	}
+	return true
+}
+
+func checkpointHub(hub *Hub, hubData *HubCommData) {
+	if err := hub.Checkpoint(hubData.SessionID, hubData.HubSequenceNumber, hub.ExpectedSequenceForApp); err != nil {
+		hub.Logger.Print("Could not save checkpoint: ", err)
+	}
+}
@@ -0,0 +1,336 @@
+package gonetworktest
+
+// An in-memory transport, for running Hubs, Apps and Gobs together in one program without a network
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryTransportQueueLength is how many datagrams wait for a reader before more are dropped, if not configured
+const MemoryTransportQueueLength = 1024
+
+// memoryFirstEphemeralPort is where ports handed out for port 0 start
+const memoryFirstEphemeralPort = 49152
+
+// ErrMemoryConnectionRefused is returned when dialing a stream port nobody listens on
+var ErrMemoryConnectionRefused = errors.New("connection refused")
+
+// MemoryTransport delivers datagrams and streams inside the program. Only the port of an address
+// matters. Every datagram sent to a port goes to every connection listening on it, the way a
+// broadcast does, and is dropped for a listener whose queue is full, the way UDP does. Connections
+// get addresses on 127.0.0.1.
+type MemoryTransport struct {
+	QueueLength int
+	mutex       sync.Mutex
+	packetPorts map[int][]*memoryPacketConn
+	streamPorts map[int]*memoryListener
+	nextPort    int
+}
+
+// memoryDatagram is a datagram waiting to be read, and where it came from
+type memoryDatagram struct {
+	payload []byte
+	source  net.Addr
+}
+
+// memoryPacketConn is a datagram connection of a MemoryTransport. A dialed one has a remote address.
+type memoryPacketConn struct {
+	transport    *MemoryTransport
+	address      *net.UDPAddr
+	remote       *net.UDPAddr
+	datagrams    chan memoryDatagram
+	closed       chan bool
+	closeOnce    sync.Once
+	mutex        sync.Mutex
+	readDeadline time.Time
+}
+
+// memoryListener is a stream listener of a MemoryTransport
+type memoryListener struct {
+	transport   *MemoryTransport
+	address     *net.TCPAddr
+	connections chan net.Conn
+	closed      chan bool
+	closeOnce   sync.Once
+}
+
+// InitMemoryTransport initializes an empty in-memory transport
+func InitMemoryTransport(transport *MemoryTransport) {
+	transport.QueueLength = MemoryTransportQueueLength
+	transport.packetPorts = make(map[int][]*memoryPacketConn)
+	transport.streamPorts = make(map[int]*memoryListener)
+	transport.nextPort = memoryFirstEphemeralPort
+}
+
+// MemoryConfiguration returns the configuration with the addresses set for running a Hub, a Gob and
+// Apps together over a MemoryTransport, where only the ports matter. With unicast fan-out, every
+// App and the Gob listen on a port of their own, and register it with the Hub.
+func MemoryConfiguration(configuration Configuration) Configuration {
+	configuration.HubSinkAddress = ":9998"
+	configuration.HubRiseAddress = ":9999"
+	configuration.AppSinkAddress = ":9999"
+	configuration.AppRiseAddress = ":9998"
+	configuration.GobSinkAddress = ":9996"
+	configuration.GobTCPAddress = ":9996"
+	configuration.AppGobRiseAddress = ":9996"
+	if configuration.HubUnicastFanOut {
+		configuration.HubRiseAddress = ""
+		configuration.AppSinkAddress = ":0"
+	}
+	return configuration
+}
+
+// memoryPort finds the port of an address, like ":2323" or "192.0.2.255:2323"
+func memoryPort(address string) (int, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	if port == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(port)
+}
+
+// ephemeralPort hands out a port that is in use by neither datagrams nor streams. Call it with the
+// mutex held.
+func ephemeralPort(transport *MemoryTransport) int {
+	for {
+		port := transport.nextPort
+		transport.nextPort++
+		if transport.nextPort > 0xffff {
+			transport.nextPort = memoryFirstEphemeralPort
+		}
+		if len(transport.packetPorts[port]) == 0 && transport.streamPorts[port] == nil {
+			return port
+		}
+	}
+}
+
+// ListenPacket listens for datagrams sent to the port of the address. Port 0 gets a free port.
+func (transport *MemoryTransport) ListenPacket(address string) (net.PacketConn, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return listenMemoryPacket(transport, port, nil), nil
+}
+
+func listenMemoryPacket(transport *MemoryTransport, port int, remote *net.UDPAddr) *memoryPacketConn {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if port == 0 {
+		port = ephemeralPort(transport)
+	}
+	queueLength := transport.QueueLength
+	if queueLength <= 0 {
+		queueLength = MemoryTransportQueueLength
+	}
+	conn := &memoryPacketConn{
+		transport: transport,
+		address:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		remote:    remote,
+		datagrams: make(chan memoryDatagram, queueLength),
+		closed:    make(chan bool),
+	}
+	transport.packetPorts[port] = append(transport.packetPorts[port], conn)
+	return conn
+}
+
+// DialPacket sets up a connection, on a free port, for sending datagrams to the port of the address
+func (transport *MemoryTransport) DialPacket(address string) (net.Conn, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return listenMemoryPacket(transport, 0, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}), nil
+}
+
+// ListenStream listens for stream connections to the port of the address. Port 0 gets a free port.
+func (transport *MemoryTransport) ListenStream(address string) (net.Listener, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if port == 0 {
+		port = ephemeralPort(transport)
+	}
+	if transport.streamPorts[port] != nil {
+		return nil, errors.New("address already in use")
+	}
+	listener := &memoryListener{
+		transport:   transport,
+		address:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		connections: make(chan net.Conn),
+		closed:      make(chan bool),
+	}
+	transport.streamPorts[port] = listener
+	return listener, nil
+}
+
+// DialStream opens a stream connection to whoever listens on the port of the address
+func (transport *MemoryTransport) DialStream(address string) (net.Conn, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+	transport.mutex.Lock()
+	listener := transport.streamPorts[port]
+	transport.mutex.Unlock()
+	if listener == nil {
+		return nil, ErrMemoryConnectionRefused
+	}
+	client, server := net.Pipe()
+	select {
+	case listener.connections <- server:
+		return client, nil
+	case <-listener.closed:
+		client.Close()
+		server.Close()
+		return nil, ErrMemoryConnectionRefused
+	}
+}
+
+// deliverMemoryDatagram gives a copy of a datagram to everyone listening on the port
+func deliverMemoryDatagram(transport *MemoryTransport, port int, payload []byte, source net.Addr) {
+	datagram := memoryDatagram{payload: append([]byte(nil), payload...), source: source}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	for _, conn := range transport.packetPorts[port] {
+		select {
+		case conn.datagrams <- datagram:
+		default: // Queue full, so it is lost
+		}
+	}
+}
+
+func (conn *memoryPacketConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	conn.mutex.Lock()
+	deadline := conn.readDeadline
+	conn.mutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case datagram := <-conn.datagrams:
+		return copy(buffer, datagram.payload), datagram.source, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (conn *memoryPacketConn) WriteTo(payload []byte, address net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	var port int
+	if udpAddress, ok := address.(*net.UDPAddr); ok {
+		port = udpAddress.Port
+	} else {
+		var err error
+		if port, err = memoryPort(address.String()); err != nil {
+			return 0, err
+		}
+	}
+	deliverMemoryDatagram(conn.transport, port, payload, conn.address)
+	return len(payload), nil
+}
+
+func (conn *memoryPacketConn) Read(buffer []byte) (int, error) {
+	n, _, err := conn.ReadFrom(buffer)
+	return n, err
+}
+
+func (conn *memoryPacketConn) Write(payload []byte) (int, error) {
+	if conn.remote == nil {
+		return 0, errors.New("not connected")
+	}
+	return conn.WriteTo(payload, conn.remote)
+}
+
+// Close stops listening. A read waiting for a datagram returns net.ErrClosed.
+func (conn *memoryPacketConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		transport := conn.transport
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		conns := transport.packetPorts[conn.address.Port]
+		for i, other := range conns {
+			if other == conn {
+				transport.packetPorts[conn.address.Port] = append(conns[:i:i], conns[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
+
+func (conn *memoryPacketConn) LocalAddr() net.Addr {
+	return conn.address
+}
+
+func (conn *memoryPacketConn) RemoteAddr() net.Addr {
+	if conn.remote == nil {
+		return nil
+	}
+	return conn.remote
+}
+
+// SetDeadline only sets the read deadline, since writes never wait
+func (conn *memoryPacketConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline applies to reads started after it is set
+func (conn *memoryPacketConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = t
+	return nil
+}
+
+func (conn *memoryPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (listener *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case connection := <-listener.connections:
+		return connection, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *memoryListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+		transport := listener.transport
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		delete(transport.streamPorts, listener.address.Port)
+	})
+	return nil
+}
+
+func (listener *memoryListener) Addr() net.Addr {
+	return listener.address
+}
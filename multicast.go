@@ -0,0 +1,121 @@
+package gonetworktest
+
+// IP multicast, as an alternative to subnet broadcast for any of the addresses, over IPv4 or IPv6
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// ErrMulticastTTL is returned when MulticastTTL is out of range
+var ErrMulticastTTL = errors.New("multicast TTL must be between 0 and 255")
+
+// multicastGroup returns the IP multicast group of an address, if it is one, and the zone given
+// with it, like the eth0 of "[ff02::4242%eth0]:9999"
+func multicastGroup(address string) (net.IP, string, bool) {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil || !udpAddress.IP.IsMulticast() {
+		return nil, "", false
+	}
+	return udpAddress.IP, udpAddress.Zone, true
+}
+
+// multicastInterfaceIndex finds the index of a network interface by name, or by number as in the
+// zone "%2". Zero, which lets the system choose, if no name is given.
+func multicastInterfaceIndex(name string) (int, error) {
+	if name == "" {
+		return 0, nil
+	}
+	if index, err := strconv.Atoi(name); err == nil {
+		return index, nil
+	}
+	networkInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return networkInterface.Index, nil
+}
+
+// controlMulticastSending sets how multicast is sent from a socket. Only settings that differ
+// from the system defaults are set, so sockets that never send multicast are left as they were.
+// An IPv6 socket may send IPv4 too, so it gets the IPv4 settings as well, where the system allows.
+func controlMulticastSending(transport UDPTransport, network string, c syscall.RawConn) error {
+	if transport.MulticastTTL < 0 || transport.MulticastTTL > 255 {
+		return ErrMulticastTTL
+	}
+	interfaceIndex, err := multicastInterfaceIndex(transport.MulticastInterface)
+	if err != nil {
+		return err
+	}
+	var operr error
+	var fn = func(s uintptr) {
+		fd := int(s)
+		ipv4Err := setMulticastOptions(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, syscall.IP_MULTICAST_LOOP, transport)
+		if ipv4Err == nil && interfaceIndex != 0 {
+			ipv4Err = syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(interfaceIndex)})
+		}
+		if network != "udp6" {
+			operr = ipv4Err
+			return
+		}
+		operr = setMulticastOptions(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, syscall.IPV6_MULTICAST_LOOP, transport)
+		if operr == nil && interfaceIndex != 0 {
+			operr = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, interfaceIndex)
+		}
+	}
+	if err := c.Control(fn); err != nil {
+		return err
+	}
+	return operr
+}
+
+// setMulticastOptions sets the TTL and loopback of multicast sent from a socket, for one IP version
+func setMulticastOptions(fd int, level int, ttlOption int, loopOption int, transport UDPTransport) error {
+	if transport.MulticastTTL > 0 {
+		if err := syscall.SetsockoptInt(fd, level, ttlOption, transport.MulticastTTL); err != nil {
+			return err
+		}
+	}
+	if transport.MulticastDisableLoopback {
+		return syscall.SetsockoptInt(fd, level, loopOption, 0)
+	}
+	return nil
+}
+
+// joinMulticastGroup makes a listening socket receive what is sent to a multicast group. It is
+// joined on the interface of the zone, if there is one, then on the named interface, and on the
+// one the system chooses if neither is given.
+func joinMulticastGroup(pc net.PacketConn, group net.IP, zone string, interfaceName string) error {
+	if zone != "" {
+		interfaceName = zone
+	}
+	interfaceIndex, err := multicastInterfaceIndex(interfaceName)
+	if err != nil {
+		return err
+	}
+	udpConnection, ok := pc.(*net.UDPConn)
+	if !ok {
+		return errors.New("can only join multicast groups with UDP")
+	}
+	c, err := udpConnection.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	var fn = func(s uintptr) {
+		if group4 := group.To4(); group4 != nil {
+			request := &syscall.IPMreqn{Ifindex: int32(interfaceIndex)}
+			copy(request.Multiaddr[:], group4)
+			operr = syscall.SetsockoptIPMreqn(int(s), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, request)
+			return
+		}
+		request := &syscall.IPv6Mreq{Interface: uint32(interfaceIndex)}
+		copy(request.Multiaddr[:], group.To16())
+		operr = syscall.SetsockoptIPv6Mreq(int(s), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, request)
+	}
+	if err := c.Control(fn); err != nil {
+		return err
+	}
+	return operr
+}
@@ -0,0 +1,111 @@
+package gonetworktest
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMulticastLoopbackIPv6 sends a datagram to a link-local IPv6 multicast group on the loopback
+// interface, and receives it. Skipped where lo has no IPv6 multicast, or no route for it.
+func TestMulticastLoopbackIPv6(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil || loopback.Flags&net.FlagMulticast == 0 {
+		t.Skip("No multicast on lo")
+	}
+	transport := UDPTransport{MulticastInterface: "lo"}
+	pc, err := transport.ListenPacket("[ff02::4242%lo]:0")
+	if err != nil {
+		t.Skip("Can't join IPv6 multicast group on lo: ", err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	configuration := Configuration{
+		HubRiseAddress:     "[ff02::4242%lo]:" + strconv.Itoa(port),
+		AppSinkAddress:     "[ff02::4242%lo]:" + strconv.Itoa(port),
+		MulticastInterface: "lo",
+	}
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	connection, err := transport.DialPacket(configuration.HubRiseAddress)
+	if err != nil {
+		t.Skip("No IPv6 multicast route on lo: ", err)
+	}
+	defer connection.Close()
+	if _, err := connection.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, BufferAllocationSize)
+	size, _, err := pc.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal("Nothing received from the multicast group: ", err)
+	}
+	if string(buffer[:size]) != "hello" {
+		t.Errorf("Received %q, expected %q", buffer[:size], "hello")
+	}
+}
+
+// multicastTestInterface returns the interface to try IPv4 multicast on: lo, if it has multicast,
+// or else the first interface that is up and has it
+func multicastTestInterface() (string, bool) {
+	if loopback, err := net.InterfaceByName("lo"); err == nil && loopback.Flags&net.FlagMulticast != 0 {
+		return loopback.Name, true
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", false
+	}
+	for _, networkInterface := range interfaces {
+		if networkInterface.Flags&net.FlagUp != 0 && networkInterface.Flags&net.FlagMulticast != 0 {
+			return networkInterface.Name, true
+		}
+	}
+	return "", false
+}
+
+// TestMulticastLoopbackIPv4 sends a datagram to an administratively scoped IPv4 multicast group,
+// and receives it on the same host through multicast loopback. Skipped only where no interface
+// has multicast.
+func TestMulticastLoopbackIPv4(t *testing.T) {
+	interfaceName, ok := multicastTestInterface()
+	if !ok {
+		t.Skip("No interface with multicast")
+	}
+	transport := UDPTransport{MulticastInterface: interfaceName}
+	pc, err := transport.ListenPacket("239.255.42.42:0")
+	if err != nil {
+		t.Fatal("Can't join IPv4 multicast group on ", interfaceName, ": ", err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	configuration := Configuration{
+		HubRiseAddress:     "239.255.42.42:" + strconv.Itoa(port),
+		AppSinkAddress:     "239.255.42.42:" + strconv.Itoa(port),
+		MulticastInterface: interfaceName,
+	}
+	if err := ValidateConfiguration(configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	connection, err := configuredUDPTransport(configuration).DialPacket(configuration.HubRiseAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	if _, err := connection.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, BufferAllocationSize)
+	size, _, err := pc.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal("Nothing received from the multicast group on ", interfaceName, ": ", err)
+	}
+	if string(buffer[:size]) != "hello" {
+		t.Errorf("Received %q, expected %q", buffer[:size], "hello")
+	}
+}
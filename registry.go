@@ -0,0 +1,125 @@
+package gonetworktest
+
+// Registry of App message types, so that received App messages can be handled by type
+import (
+	"errors"
+	"fmt"
+)
+
+// Message types from SystemMessageTypeFirst and up are reserved for system messages. Everything
+// below is free for Apps to use.
+const (
+	SystemMessageTypeFirst uint16 = 0xff00
+	// MessageTypeHeartbeat and MessageTypeGapRequest are sent from App to App, and sequenced by the
+	// Hub like any other App message
+	MessageTypeHeartbeat  uint16 = 0xff00
+	MessageTypeGapRequest uint16 = 0xff01
+	// MessageTypeSessionStart tells the Hub which App sequence number an App sends next
+	MessageTypeSessionStart uint16 = 0xff02
+	// MessageTypeHubSessionStart starts every Hub session, telling where the previous one ended. It
+	// comes from the Hub itself, with App ID 0.
+	MessageTypeHubSessionStart uint16 = 0xff03
+	// MessageTypeHubRegistration is sent to a Hub doing unicast fan-out, and is never sequenced
+	MessageTypeHubRegistration uint16 = 0xff04
+	// MessageTypeAdmin is sent from App to App, like MessageTypeHeartbeat and MessageTypeGapRequest
+	MessageTypeAdmin uint16 = 0xff05
+)
+
+// ErrMessageTypeReserved is returned when an App registers or sends a message type reserved for
+// system messages
+var ErrMessageTypeReserved = errors.New("message type is reserved for system messages")
+
+// ErrMessageTypeRegistered is returned when a message type is registered twice
+var ErrMessageTypeRegistered = errors.New("message type is already registered")
+
+// ErrNoMessageHandler is returned when a message type is registered without a handler
+var ErrNoMessageHandler = errors.New("message type has no handler")
+
+// MessageHandler handles a received App message. decoded is what the decoder of the message type
+// returned, or the raw payload if there is no decoder.
+type MessageHandler func(data *AppCommData, decoded interface{})
+
+// MessageDecoder turns the payload of an App message into something easier to handle
+type MessageDecoder func(payload []byte) (interface{}, error)
+
+// MessageType is what is registered for one App message type
+type MessageType struct {
+	Name    string
+	Handler MessageHandler
+	Decoder MessageDecoder // Optional
+}
+
+// MessageTypeRegistry maps App message types to their handlers
+type MessageTypeRegistry struct {
+	Types map[uint16]MessageType
+	// Unhandled is called for App messages of types that aren't registered, if set
+	Unhandled MessageHandler
+}
+
+// InitMessageTypeRegistry initializes an empty registry
+func InitMessageTypeRegistry(registry *MessageTypeRegistry) {
+	registry.Types = make(map[uint16]MessageType)
+	registry.Unhandled = nil
+}
+
+// IsSystemMessageType tells if a message type is reserved for system messages
+func IsSystemMessageType(messageType uint16) bool {
+	return messageType >= SystemMessageTypeFirst
+}
+
+// IsSequencedSystemMessageType tells if a system message type is sent from App to App, so that the
+// Hub sequences it like any other App message, and Apps that register a handler for it get it
+func IsSequencedSystemMessageType(messageType uint16) bool {
+	return messageType == MessageTypeHeartbeat || messageType == MessageTypeGapRequest || messageType == MessageTypeAdmin
+}
+
+// RegisterMessageType registers the handler, and optionally a decoder, for an App message type
+func RegisterMessageType(registry *MessageTypeRegistry, messageType uint16, name string, handler MessageHandler, decoder MessageDecoder) error {
+	if IsSystemMessageType(messageType) {
+		return ErrMessageTypeReserved
+	}
+	return registerMessageType(registry, messageType, name, handler, decoder)
+}
+
+// RegisterSystemMessageType registers the handler, and optionally a decoder, for a message type
+// reserved for system messages
+func RegisterSystemMessageType(registry *MessageTypeRegistry, messageType uint16, name string, handler MessageHandler, decoder MessageDecoder) error {
+	if !IsSystemMessageType(messageType) {
+		return fmt.Errorf("message type %d is not a system message type", messageType)
+	}
+	return registerMessageType(registry, messageType, name, handler, decoder)
+}
+
+func registerMessageType(registry *MessageTypeRegistry, messageType uint16, name string, handler MessageHandler, decoder MessageDecoder) error {
+	if handler == nil {
+		return ErrNoMessageHandler
+	}
+	if _, ok := registry.Types[messageType]; ok {
+		return ErrMessageTypeRegistered
+	}
+	registry.Types[messageType] = MessageType{Name: name, Handler: handler, Decoder: decoder}
+	return nil
+}
+
+// DispatchAppMessage calls the handler registered for the type of a received App message, after
+// decoding the payload if the type has a decoder. Other types go to Unhandled, except system
+// messages, which nobody has asked for. Returns the error of the decoder, if it fails.
+func DispatchAppMessage(registry *MessageTypeRegistry, data *AppCommData) error {
+	registered, ok := registry.Types[data.Type]
+	if !ok {
+		if registry.Unhandled != nil && !IsSystemMessageType(data.Type) {
+			registry.Unhandled(data, data.Payload)
+		}
+		return nil
+	}
+	var decoded interface{} = data.Payload
+	if registered.Decoder != nil {
+		var err error
+		decoded, err = registered.Decoder(data.Payload)
+		if err != nil {
+			return fmt.Errorf("decoding %s message: %w", registered.Name, err)
+		}
+	}
+	registered.Handler(data, decoded)
+	return nil
+}
@@ -0,0 +1,91 @@
+package gonetworktest
+
+// Sending requests over the Hub, and waiting for the replies that refer to them
+import (
+	"context"
+	"sync"
+)
+
+// Requester sends requests with an App, and matches the replies the App receives with them. It may
+// be used from several goroutines at once.
+type Requester struct {
+	App *App
+	// ReplyType is the message type of the replies
+	ReplyType uint16
+	mutex     sync.Mutex
+	// Requests waiting for a reply, by App sequence number
+	waiting map[uint64]chan []byte
+}
+
+// InitRequester initializes a requester that sends its requests with an App, and subscribes the App
+// to the replies. Call it before starting the App.
+func InitRequester(requester *Requester, app *App, replyType uint16) error {
+	requester.App = app
+	requester.ReplyType = replyType
+	requester.waiting = make(map[uint64]chan []byte)
+	return SubscribeApp(app, replyType, "reply", func(data *AppCommData, decoded interface{}) {
+		handleReply(requester, data)
+	}, nil)
+}
+
+// StartRequest sends a request, and returns its App sequence number, and a channel that gets the
+// body of the reply. Returns the error of SendApp, if the request can't be sent.
+func StartRequest(requester *Requester, requestType uint16, payload []byte) (uint64, <-chan []byte, error) {
+	// Held until the request is waiting, so that not even a quick reply is missed
+	requester.mutex.Lock()
+	defer requester.mutex.Unlock()
+	sequence, err := SendApp(requester.App, requestType, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	reply := make(chan []byte, 1)
+	requester.waiting[sequence] = reply
+	return sequence, reply, nil
+}
+
+// CancelRequest stops waiting for the reply to a request. A reply arriving later is ignored.
+func CancelRequest(requester *Requester, sequence uint64) {
+	requester.mutex.Lock()
+	defer requester.mutex.Unlock()
+	delete(requester.waiting, sequence)
+}
+
+// Request sends a request, and waits for the body of the reply. Returns the error of the context if
+// it is done first, for example when it times out or is cancelled.
+func Request(ctx context.Context, requester *Requester, requestType uint16, payload []byte) ([]byte, error) {
+	sequence, reply, err := StartRequest(requester, requestType, payload)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case body := <-reply:
+		return body, nil
+	case <-ctx.Done():
+		CancelRequest(requester, sequence)
+		return nil, ctx.Err()
+	}
+}
+
+// handleReply passes a reply to one of our requests on to whoever is waiting for it
+func handleReply(requester *Requester, data *AppCommData) {
+	requester.mutex.Lock()
+	defer requester.mutex.Unlock()
+	correlation, body, err := DecodeReplyPayload(data.Payload)
+	if err != nil || correlation.ID != requester.App.State.ID {
+		return
+	}
+	reply, ok := requester.waiting[correlation.AppSequenceNumber]
+	if !ok {
+		return
+	}
+	delete(requester.waiting, correlation.AppSequenceNumber)
+	// The payload belongs to the received Hub message, so pass on a copy
+	reply <- append([]byte(nil), body...)
+}
+
+// WaitingRequests returns the number of requests still waiting for a reply
+func WaitingRequests(requester *Requester) int {
+	requester.mutex.Lock()
+	defer requester.mutex.Unlock()
+	return len(requester.waiting)
+}
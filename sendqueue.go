@@ -0,0 +1,105 @@
+package gonetworktest
+
+// Ring buffer for App messages waiting to be acknowledged by the Hub
+import (
+	"errors"
+)
+
+// SendQueueDefaultMaxCapacity is the number of entries a send queue may grow to, if not configured
+const SendQueueDefaultMaxCapacity = 1024
+
+// ErrSendQueueFull is returned when a send queue has grown to its maximum capacity
+var ErrSendQueueFull = errors.New("send queue is full")
+
+// ErrSendQueueSequence is returned when a message pushed to a send queue isn't next in sequence
+var ErrSendQueueSequence = errors.New("App sequence number is not next in send queue")
+
+// SendQueue is a ring buffer of encoded App messages, in App sequence number order. It doubles in
+// size when full, up to MaxCapacity. Each entry is only as large as the message it holds.
+type SendQueue struct {
+	Entries     [][]byte
+	Head        int // Location of the oldest entry
+	Length      int // Number of entries in use
+	MaxCapacity int
+	// App sequence number of the entry at Head
+	HeadSequenceNumber uint64
+}
+
+// InitSendQueue initializes a send queue with room for initialCapacity entries
+func InitSendQueue(queue *SendQueue, initialCapacity int, maxCapacity int) {
+	if initialCapacity < 1 {
+		initialCapacity = 1
+	}
+	if maxCapacity < initialCapacity {
+		maxCapacity = initialCapacity
+	}
+	queue.Entries = make([][]byte, initialCapacity)
+	queue.Head = 0
+	queue.Length = 0
+	queue.MaxCapacity = maxCapacity
+	queue.HeadSequenceNumber = 0
+}
+
+// PushSendQueue adds a copy of a message to the end of the queue. The App sequence number must be
+// the one after the newest entry, unless the queue is empty.
+func PushSendQueue(queue *SendQueue, sequence uint64, message []byte) error {
+	if queue.Length == 0 {
+		queue.HeadSequenceNumber = sequence
+	} else if sequence != queue.HeadSequenceNumber+uint64(queue.Length) {
+		return ErrSendQueueSequence
+	}
+	if queue.Length == len(queue.Entries) {
+		if !growSendQueue(queue) {
+			return ErrSendQueueFull
+		}
+	}
+	location := (queue.Head + queue.Length) % len(queue.Entries)
+	// Reuse the space of an acknowledged entry if it is large enough
+	if cap(queue.Entries[location]) < len(message) {
+		queue.Entries[location] = make([]byte, len(message))
+	}
+	queue.Entries[location] = queue.Entries[location][:len(message)]
+	copy(queue.Entries[location], message)
+	queue.Length++
+	return nil
+}
+
+// growSendQueue doubles the capacity of the queue, keeping the entries in order
+func growSendQueue(queue *SendQueue) bool {
+	capacity := len(queue.Entries)
+	if capacity >= queue.MaxCapacity {
+		return false
+	}
+	newCapacity := capacity * 2
+	if newCapacity > queue.MaxCapacity {
+		newCapacity = queue.MaxCapacity
+	}
+	entries := make([][]byte, newCapacity)
+	for i := 0; i < queue.Length; i++ {
+		entries[i] = queue.Entries[(queue.Head+i)%capacity]
+	}
+	queue.Entries = entries
+	queue.Head = 0
+	return true
+}
+
+// PeekSendQueue returns the entry at a position counted from the oldest one, without removing it
+func PeekSendQueue(queue *SendQueue, position int) ([]byte, bool) {
+	if position < 0 || position >= queue.Length {
+		return nil, false
+	}
+	return queue.Entries[(queue.Head+position)%len(queue.Entries)], true
+}
+
+// AcknowledgeSendQueue removes all entries up to and including the given App sequence number, and
+// returns how many were removed. Sequence numbers outside the queue are ignored.
+func AcknowledgeSendQueue(queue *SendQueue, sequence uint64) int {
+	if sequence < queue.HeadSequenceNumber || sequence-queue.HeadSequenceNumber >= uint64(queue.Length) {
+		return 0
+	}
+	acknowledged := int(sequence-queue.HeadSequenceNumber) + 1
+	queue.Head = (queue.Head + acknowledged) % len(queue.Entries)
+	queue.Length -= acknowledged
+	queue.HeadSequenceNumber += uint64(acknowledged)
+	return acknowledged
+}
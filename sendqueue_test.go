@@ -0,0 +1,132 @@
+package gonetworktest
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testSendQueueMessage is the message pushed with an App sequence number
+func testSendQueueMessage(sequence uint64) []byte {
+	return []byte(fmt.Sprint("message ", sequence))
+}
+
+// pushSendQueue pushes the messages with App sequence numbers from and up to, but not including, to
+func pushSendQueue(t *testing.T, queue *SendQueue, from uint64, to uint64) {
+	t.Helper()
+	for sequence := from; sequence < to; sequence++ {
+		if err := PushSendQueue(queue, sequence, testSendQueueMessage(sequence)); err != nil {
+			t.Fatalf("Pushing %d: %v", sequence, err)
+		}
+	}
+}
+
+// checkSendQueue checks that the queue holds the messages from and up to, but not including, to
+func checkSendQueue(t *testing.T, queue *SendQueue, from uint64, to uint64) {
+	t.Helper()
+	if queue.HeadSequenceNumber != from || queue.Length != int(to-from) {
+		t.Fatalf("Queue holds %d from %d, expected %d from %d", queue.Length, queue.HeadSequenceNumber, to-from, from)
+	}
+	for position := 0; position < queue.Length; position++ {
+		message, ok := PeekSendQueue(queue, position)
+		if expected := testSendQueueMessage(from + uint64(position)); !ok || string(message) != string(expected) {
+			t.Errorf("Position %d holds %q, expected %q", position, message, expected)
+		}
+	}
+	if _, ok := PeekSendQueue(queue, queue.Length); ok {
+		t.Error("Peeking past the newest entry found something")
+	}
+}
+
+func TestSendQueueWrap(t *testing.T) {
+	var queue SendQueue
+	InitSendQueue(&queue, 4, 4)
+	pushSendQueue(t, &queue, 100, 104)
+	if AcknowledgeSendQueue(&queue, 102) != 3 {
+		t.Fatal("Expected 3 entries acknowledged")
+	}
+	// The new entries go in front of the remaining one
+	pushSendQueue(t, &queue, 104, 107)
+	if queue.Head != 3 {
+		t.Fatalf("Head is %d, expected 3", queue.Head)
+	}
+	checkSendQueue(t, &queue, 103, 107)
+	if len(queue.Entries) != 4 {
+		t.Errorf("Capacity is %d, expected 4", len(queue.Entries))
+	}
+}
+
+func TestSendQueueGrowWhileWrapped(t *testing.T) {
+	var queue SendQueue
+	InitSendQueue(&queue, 4, 16)
+	pushSendQueue(t, &queue, 0, 4)
+	AcknowledgeSendQueue(&queue, 1)
+	pushSendQueue(t, &queue, 4, 6)
+	// Full and wrapped, so growing has to keep the entries in order
+	pushSendQueue(t, &queue, 6, 11)
+	checkSendQueue(t, &queue, 2, 11)
+	if len(queue.Entries) != 16 {
+		t.Errorf("Capacity is %d, expected 16", len(queue.Entries))
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	var queue SendQueue
+	InitSendQueue(&queue, 2, 6)
+	pushSendQueue(t, &queue, 0, 6)
+	if len(queue.Entries) != 6 {
+		t.Errorf("Capacity is %d, expected it to stop at 6", len(queue.Entries))
+	}
+	if err := PushSendQueue(&queue, 6, testSendQueueMessage(6)); err != ErrSendQueueFull {
+		t.Fatalf("Pushing to a full queue returned %v, expected ErrSendQueueFull", err)
+	}
+	checkSendQueue(t, &queue, 0, 6)
+	// Room again once something is acknowledged
+	AcknowledgeSendQueue(&queue, 0)
+	pushSendQueue(t, &queue, 6, 7)
+	checkSendQueue(t, &queue, 1, 7)
+}
+
+func TestSendQueueSequence(t *testing.T) {
+	var queue SendQueue
+	InitSendQueue(&queue, 4, 4)
+	pushSendQueue(t, &queue, 10, 12)
+	for _, sequence := range []uint64{10, 11, 13, 0} {
+		if err := PushSendQueue(&queue, sequence, testSendQueueMessage(sequence)); err != ErrSendQueueSequence {
+			t.Errorf("Pushing %d after 11 returned %v, expected ErrSendQueueSequence", sequence, err)
+		}
+	}
+	checkSendQueue(t, &queue, 10, 12)
+	// An empty queue starts from anything
+	AcknowledgeSendQueue(&queue, 11)
+	pushSendQueue(t, &queue, 50, 51)
+	checkSendQueue(t, &queue, 50, 51)
+}
+
+func TestSendQueueAcknowledge(t *testing.T) {
+	tests := []struct {
+		name         string
+		sequence     uint64
+		acknowledged int
+		from         uint64
+	}{
+		{"before head", 9, 0, 10},
+		{"far before head", 0, 0, 10},
+		{"head", 10, 1, 11},
+		{"middle", 12, 3, 13},
+		{"newest", 14, 5, 15},
+		{"past newest", 15, 0, 10},
+		{"far past newest", 1 << 63, 0, 10},
+		{"highest", ^uint64(0), 0, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var queue SendQueue
+			InitSendQueue(&queue, 4, 8)
+			pushSendQueue(t, &queue, 10, 15)
+			if acknowledged := AcknowledgeSendQueue(&queue, test.sequence); acknowledged != test.acknowledged {
+				t.Errorf("Acknowledged %d entries, expected %d", acknowledged, test.acknowledged)
+			}
+			checkSendQueue(t, &queue, test.from, 15)
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package gonetworktest
+
+// Running a Hub, a Gob and a number of Apps together in one program, over an in-memory transport that
+// injects faults, and checking that every App receives the same App messages in the same order, with
+// no gaps or duplicates
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// simulationFirstAppID is the ID of the first simulated App. The others follow it.
+const simulationFirstAppID = 1000
+
+// simulationSettleTime is how long to keep listening after every App has all App messages, to
+// catch duplicates
+const simulationSettleTime = 500 * time.Millisecond
+
+// simulationMaxProblems is how many problems are reported for each App
+const simulationMaxProblems = 5
+
+// ErrSimulationApps is returned when a simulation has more senders or late Apps than Apps
+var ErrSimulationApps = errors.New("senders can't start late, and there can't be more senders or late Apps than Apps")
+
+// Simulation runs a Hub, a Gob and a number of Apps together, over a MemoryTransport wrapped in a
+// FaultTransport. Some of the Apps send App messages, some start late and catch up from the Gob,
+// and all of them record what they receive. Set the fields before running it.
+type Simulation struct {
+	Apps     int // Number of Apps, all of them receiving
+	Senders  int // Number of the Apps that also send
+	Late     int // Number of the Apps that start a third of the way through, and catch up from the Gob
+	Messages int // App messages sent by each sending App
+	// RestartHub stops the Hub half way through, and starts a new one that carries on from where the
+	// checkpoint of the old one says it ended. The late Apps have started by then, since catching up
+	// only fetches the latest session.
+	RestartHub bool
+	// RestartApp stops the last sending App half way through its App messages, while some of them
+	// are still in flight, and starts it again
+	RestartApp bool
+	// Configuration holds the fault probabilities and seed, and HubUnicastFanOut. The addresses and
+	// the send window are set by the simulation.
+	Configuration Configuration
+	// Timeout is how long to wait for every App to get every App message
+	Timeout time.Duration
+	// Logger gets the progress and the results. ServiceLogger gets what the Hub and the Gob log,
+	// while the Apps log with the log package.
+	Logger        *log.Logger
+	ServiceLogger *log.Logger
+}
+
+// simulatedApp is an App that records every App message it receives, in order
+type simulatedApp struct {
+	app        App
+	mutex      sync.Mutex
+	deliveries []simulatedDelivery
+	runs       []simulatedRun // One for each time the App started sending
+	heard      bool           // Whether the Hub has been heard from
+}
+
+// simulatedDelivery is an App message as received by an App
+type simulatedDelivery struct {
+	ID                uint64
+	AppSequenceNumber uint64
+	Payload           string
+}
+
+// simulatedRun is where a run of a sending App started, both as App sequence number, and as the
+// number of the App message it sent first
+type simulatedRun struct {
+	firstSequence uint64
+	firstMessage  uint64
+}
+
+// simulatedCheckpoint is the latest checkpoint of the simulated Hub
+type simulatedCheckpoint struct {
+	mutex                  sync.Mutex
+	sessionID              uint64
+	hubSequenceNumber      uint64
+	expectedSequenceForApp map[uint64]uint64
+}
+
+// InitSimulation initializes a simulation of 4 Apps, 2 of them sending 500 App messages each, and 1
+// starting late, with the faults of the configuration
+func InitSimulation(simulation *Simulation, configuration Configuration) {
+	simulation.Apps = 4
+	simulation.Senders = 2
+	simulation.Late = 1
+	simulation.Messages = 500
+	simulation.RestartHub = false
+	simulation.RestartApp = false
+	simulation.Configuration = configuration
+	simulation.Timeout = 2 * time.Minute
+	simulation.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	simulation.ServiceLogger = log.New(io.Discard, "", 0)
+}
+
+// RunSimulation runs a simulation until every App has every App message, or the timeout passes. It
+// returns what went wrong, if any App didn't get the App messages of every sender exactly once and
+// in the order they were sent, or the Apps didn't all get them in the same total order. Returns an
+// error if the simulation couldn't start.
+func RunSimulation(simulation *Simulation) ([]string, error) {
+	if simulation.Senders > simulation.Apps-simulation.Late || simulation.Late > simulation.Apps || simulation.Late < 0 {
+		return nil, ErrSimulationApps
+	}
+	results := simulation.Logger
+
+	configuration := MemoryConfiguration(simulation.Configuration)
+	configuration.MaxSendsInFlight = 10
+	configuration.SendQueueMaxCapacity = 1024
+	configuration.HubMaxDatagramSize = HubDefaultMaxDatagramSize
+	configuration.HubMaxLingerMicroseconds = 100
+	if err := ValidateConfiguration(configuration); err != nil {
+		return nil, err
+	}
+
+	var memory MemoryTransport
+	InitMemoryTransport(&memory)
+	var faults FaultTransport
+	InitFaultTransport(&faults, &memory, configuration)
+
+	// The Hub and the Gob run until the end. Whatever makes them fail is a problem too.
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	defer running.Wait()
+	defer cancel()
+	var failuresMutex sync.Mutex
+	var failures []string
+	fail := func(problem string) {
+		failuresMutex.Lock()
+		defer failuresMutex.Unlock()
+		failures = append(failures, problem)
+	}
+	var gob Gob
+	InitGob(&gob, configuration)
+	gob.Transport = &memory // Nobody fills the gaps of a Gob
+	gob.Logger = simulation.ServiceLogger
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		if err := RunGob(ctx, &gob); err != nil {
+			fail(fmt.Sprint("Gob failed: ", err))
+		}
+	}()
+	// A Gob only has the Hub messages it heard, so the Hub starts once it listens
+	if err := WaitForGob(&memory, configuration, simulation.Timeout); err != nil {
+		return nil, err
+	}
+	var checkpoint simulatedCheckpoint
+	stopHub := startSimulatedHub(ctx, simulation, configuration, &faults, &checkpoint, fail, &running)
+
+	results.Print("Simulating ", simulation.Apps, " Apps, ", simulation.Senders, " sending ", simulation.Messages, " App messages each, and ", simulation.Late, " starting late")
+	started := time.Now()
+	deadline := started.Add(simulation.Timeout)
+	simulated := make([]*simulatedApp, simulation.Apps)
+	for i := range simulated {
+		simulated[i] = &simulatedApp{}
+		appConfiguration := configuration
+		appConfiguration.AppCatchUpOnStart = i >= simulation.Apps-simulation.Late
+		initSimulatedApp(simulated[i], uint64(simulationFirstAppID+i), appConfiguration, &faults)
+	}
+	defer func() {
+		for _, app := range simulated {
+			StopApp(&app.app)
+		}
+	}()
+	for _, app := range simulated[:simulation.Apps-simulation.Late] {
+		if err := StartApp(&app.app); err != nil {
+			return nil, err
+		}
+	}
+	// Apps that don't catch up start from the first Hub message they hear, so nothing is sent until
+	// every one of them has heard the Hub
+	for _, app := range simulated[:simulation.Apps-simulation.Late] {
+		for !simulatedAppHeard(app) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	var sending sync.WaitGroup
+	for i, app := range simulated[:simulation.Senders] {
+		restartAt := -1
+		if simulation.RestartApp && i == simulation.Senders-1 {
+			restartAt = simulation.Messages / 2
+		}
+		sending.Add(1)
+		go func(app *simulatedApp) {
+			defer sending.Done()
+			if err := sendSimulatedMessages(app, simulation.Messages, restartAt, deadline); err != nil {
+				fail(fmt.Sprint("App ", app.app.State.ID, " couldn't send: ", err))
+			}
+		}(app)
+	}
+
+	// Start the late Apps when a third of the App messages have arrived, and restart the Hub at half
+	total := simulation.Senders * simulation.Messages
+	waitForSimulatedDeliveries(simulated[:1], total/3, deadline)
+	for _, app := range simulated[simulation.Apps-simulation.Late:] {
+		if err := StartApp(&app.app); err != nil {
+			return nil, err
+		}
+	}
+	if simulation.RestartHub {
+		waitForSimulatedDeliveries(simulated[:1], total/2, deadline)
+		stopHub()
+		results.Print("Restarting the Hub")
+		stopHub = startSimulatedHub(ctx, simulation, configuration, &faults, &checkpoint, fail, &running)
+	}
+	sending.Wait()
+	complete := waitForSimulatedDeliveries(simulated, total, deadline)
+	elapsed := time.Since(started)
+	time.Sleep(simulationSettleTime)
+	for _, app := range simulated {
+		StopApp(&app.app)
+	}
+	stopHub()
+
+	results.Printf("Faults: %+v", FaultTransportCounts(&faults))
+	problems := checkSimulatedDeliveries(simulated, simulation.Senders, simulation.Messages)
+	if !complete {
+		problems = append(problems, fmt.Sprint("Not every App got every App message within ", simulation.Timeout))
+	}
+	failuresMutex.Lock()
+	problems = append(problems, failures...)
+	failuresMutex.Unlock()
+	if len(problems) == 0 {
+		results.Print("Every App got the same ", total, " App messages in the same order, after ", elapsed)
+	}
+	return problems, nil
+}
+
+// startSimulatedHub runs a Hub, which carries on from the checkpoint of the Hub before it, if there
+// was one. It returns a function that stops the Hub, and waits for its last checkpoint.
+func startSimulatedHub(ctx context.Context, simulation *Simulation, configuration Configuration, transport Transport, checkpoint *simulatedCheckpoint, fail func(string), running *sync.WaitGroup) func() {
+	var hub Hub
+	InitHub(&hub, configuration)
+	hub.Transport = transport
+	hub.Logger = simulation.ServiceLogger
+	checkpoint.mutex.Lock()
+	if checkpoint.sessionID != 0 {
+		hub.PreviousSessionID = checkpoint.sessionID
+		hub.PreviousHubSequenceNumber = checkpoint.hubSequenceNumber
+		for ID, sequence := range checkpoint.expectedSequenceForApp {
+			hub.ExpectedSequenceForApp[ID] = sequence
+		}
+	}
+	checkpoint.mutex.Unlock()
+	hub.Checkpoint = func(sessionID uint64, hubSequenceNumber uint64, expectedSequenceForApp map[uint64]uint64) error {
+		checkpoint.mutex.Lock()
+		defer checkpoint.mutex.Unlock()
+		checkpoint.sessionID = sessionID
+		checkpoint.hubSequenceNumber = hubSequenceNumber
+		checkpoint.expectedSequenceForApp = make(map[uint64]uint64)
+		for ID, sequence := range expectedSequenceForApp {
+			checkpoint.expectedSequenceForApp[ID] = sequence
+		}
+		return nil
+	}
+	hubCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan bool)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer close(stopped)
+		if err := RunHub(hubCtx, &hub); err != nil {
+			fail(fmt.Sprint("Hub failed: ", err))
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// initSimulatedApp sets up an App that records what it receives, its own App messages included
+func initSimulatedApp(app *simulatedApp, ID uint64, configuration Configuration, transport Transport) {
+	InitApp(&app.app, ID, configuration)
+	app.app.Transport = transport
+	app.app.DeliverOwnMessages = true
+	app.app.Registry.Unhandled = func(data *AppCommData, decoded interface{}) {
+		app.mutex.Lock()
+		defer app.mutex.Unlock()
+		app.deliveries = append(app.deliveries, simulatedDelivery{ID: data.ID, AppSequenceNumber: data.AppSequenceNumber, Payload: string(data.Payload)})
+	}
+	app.app.HubData.LivenessChanged = func(alive bool) {
+		app.mutex.Lock()
+		defer app.mutex.Unlock()
+		app.heard = app.heard || alive
+	}
+}
+
+// simulatedAppHeard tells if an App has heard from the Hub
+func simulatedAppHeard(app *simulatedApp) bool {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	return app.heard
+}
+
+// simulatedPayload is what an App sends as its message number i, so receivers can tell that it
+// arrived intact
+func simulatedPayload(ID uint64, i uint64) string {
+	return fmt.Sprint("App ", ID, " message ", i)
+}
+
+// sendSimulatedMessages sends App messages as fast as the App takes them, and waits for the Hub to
+// accept them. The App is restarted before App message number restartAt, unless it is negative,
+// and has until the deadline to get its App messages in flight accepted when stopping.
+func sendSimulatedMessages(app *simulatedApp, messages int, restartAt int, deadline time.Time) error {
+	for i := uint64(0); i < uint64(messages); {
+		if int(i) == restartAt && len(app.runs) == 1 {
+			// Stopped with App messages still in flight, which the Hub must accept before it stops,
+			// however long a Hub restart at the same time holds them up
+			stopTimeout := app.app.StopTimeout
+			app.app.StopTimeout = time.Until(deadline)
+			dropped := StopApp(&app.app)
+			app.app.StopTimeout = stopTimeout
+			if dropped > 0 {
+				return fmt.Errorf("%d App messages dropped when stopping", dropped)
+			}
+			if err := StartApp(&app.app); err != nil {
+				return err
+			}
+		}
+		sequence, err := SendApp(&app.app, 0, []byte(simulatedPayload(app.app.State.ID, i)))
+		if err == ErrAppStopped {
+			return err
+		}
+		if err != nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if int(i) == restartAt || i == 0 {
+			app.mutex.Lock()
+			app.runs = append(app.runs, simulatedRun{firstSequence: sequence, firstMessage: i})
+			app.mutex.Unlock()
+		}
+		i++
+	}
+	for AppSendsPending(&app.app) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// waitForSimulatedDeliveries waits until every App has received at least the given number of App
+// messages. Returns false if the deadline passes first.
+func waitForSimulatedDeliveries(apps []*simulatedApp, count int, deadline time.Time) bool {
+	for _, app := range apps {
+		for {
+			app.mutex.Lock()
+			received := len(app.deliveries)
+			app.mutex.Unlock()
+			if received >= count {
+				break
+			}
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return true
+}
+
+// checkSimulatedDeliveries checks that every App got the App messages of every sending App exactly
+// once, in the order they were sent, and that all Apps got them in the same total order
+func checkSimulatedDeliveries(apps []*simulatedApp, senders int, messages int) []string {
+	var problems []string
+	runs := make(map[uint64][]simulatedRun)
+	for _, sender := range apps[:senders] {
+		sender.mutex.Lock()
+		runs[sender.app.State.ID] = sender.runs
+		sender.mutex.Unlock()
+	}
+	// Copied under the lock, in case an App still records something
+	deliveriesOf := func(app *simulatedApp) []simulatedDelivery {
+		app.mutex.Lock()
+		defer app.mutex.Unlock()
+		return append([]simulatedDelivery(nil), app.deliveries...)
+	}
+	reference := deliveriesOf(apps[0])
+	for _, app := range apps {
+		deliveries := deliveriesOf(app)
+		ID := app.app.State.ID
+		appProblems := 0
+		report := func(format string, a ...interface{}) {
+			if appProblems < simulationMaxProblems {
+				problems = append(problems, fmt.Sprintf("App %d: ", ID)+fmt.Sprintf(format, a...))
+			}
+			appProblems++
+		}
+		if len(deliveries) != senders*messages {
+			report("got %d App messages, expected %d", len(deliveries), senders*messages)
+		}
+		// The next App message number expected from each sender. Each run of a sender numbers its
+		// App messages from where the run started.
+		next := make(map[uint64]uint64)
+		badPayload := 0
+		for i, got := range deliveries {
+			senderRuns, known := runs[got.ID]
+			if !known || len(senderRuns) == 0 {
+				report("got App message %d from unknown App %d", got.AppSequenceNumber, got.ID)
+				continue
+			}
+			message := next[got.ID]
+			run := senderRuns[0]
+			for _, later := range senderRuns[1:] {
+				if later.firstMessage <= message {
+					run = later
+				}
+			}
+			if expected := run.firstSequence + message - run.firstMessage; got.AppSequenceNumber != expected {
+				report("got App message %d from App %d, expected %d", got.AppSequenceNumber, got.ID, expected)
+			}
+			if got.Payload != simulatedPayload(got.ID, message) {
+				badPayload++
+			}
+			next[got.ID] = message + 1
+			if i < len(reference) && got != reference[i] {
+				report("App message number %d is %d from App %d, but App %d got %d from App %d", i, got.AppSequenceNumber, got.ID, apps[0].app.State.ID, reference[i].AppSequenceNumber, reference[i].ID)
+			}
+		}
+		if badPayload > 0 {
+			report("got %d App messages with the wrong payload", badPayload)
+		}
+		if appProblems > simulationMaxProblems {
+			problems = append(problems, fmt.Sprintf("App %d: %d more problems", ID, appProblems-simulationMaxProblems))
+		}
+	}
+	return problems
+}
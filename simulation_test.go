@@ -0,0 +1,58 @@
+package gonetworktest
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// TestSimulation runs simulations with faults, and with Hub and App restarts. Failover between
+// Hubs is tested in cmd/hub, where standby Hubs are run.
+func TestSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Simulations take several seconds each")
+	}
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+	tests := []struct {
+		name       string
+		unicast    bool
+		restartHub bool
+		restartApp bool
+	}{
+		{"broadcast", false, false, false},
+		{"unicast", true, false, false},
+		{"Hub restart", false, true, false},
+		{"App restart", false, false, true},
+		{"unicast with Hub and App restarts", true, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := Configuration{
+				FaultDropProbability:      0.02,
+				FaultDuplicateProbability: 0.02,
+				FaultReorderProbability:   0.02,
+				FaultDelayProbability:     0.02,
+				FaultTruncateProbability:  0.01,
+				FaultSeed:                 1,
+				HubUnicastFanOut:          test.unicast,
+			}
+			var simulation Simulation
+			InitSimulation(&simulation, configuration)
+			simulation.Messages = 200
+			simulation.RestartHub = test.restartHub
+			simulation.RestartApp = test.restartApp
+			simulation.Timeout = time.Minute
+			simulation.Logger = log.New(io.Discard, "", 0)
+			problems, err := RunSimulation(&simulation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
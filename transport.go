@@ -0,0 +1,80 @@
+package gonetworktest
+
+// Transports open the connections that Hubs, Apps and Gobs talk over
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Transport opens datagram and stream connections. UDPTransport uses the network, and
+// MemoryTransport stays inside the program.
+type Transport interface {
+	// ListenPacket listens for datagrams sent to an address
+	ListenPacket(address string) (net.PacketConn, error)
+	// DialPacket sets up a connection for sending datagrams to an address
+	DialPacket(address string) (net.Conn, error)
+	// ListenStream listens for stream connections to an address
+	ListenStream(address string) (net.Listener, error)
+	// DialStream opens a stream connection to an address
+	DialStream(address string) (net.Conn, error)
+}
+
+// UDPTransport sends datagrams over UDP, and streams over TCP. Several listeners may share a UDP
+// port, so Hubs, Apps and Gobs can run on the same host. Addresses may be broadcast or unicast
+// addresses, or IP multicast groups, which listeners join. The zero value sends multicast the way
+// the system does by default.
+type UDPTransport struct {
+	MulticastInterface       string // Interface to send multicast and join groups on. The system chooses if empty.
+	MulticastTTL             int    // Hops multicast may travel. The system default, 1, if zero.
+	MulticastDisableLoopback bool   // Don't deliver multicast sent from this host to this host
+}
+
+// configuredUDPTransport returns a UDPTransport with the multicast settings of the configuration
+func configuredUDPTransport(configuration Configuration) UDPTransport {
+	return UDPTransport{
+		MulticastInterface:       configuration.MulticastInterface,
+		MulticastTTL:             configuration.MulticastTTL,
+		MulticastDisableLoopback: configuration.MulticastDisableLoopback,
+	}
+}
+
+// control sets up every socket, before it is bound or connected
+func (transport UDPTransport) control(network string, address string, c syscall.RawConn) error {
+	if err := ControlOnConnSetupSoReusePort(network, address, c); err != nil {
+		return err
+	}
+	return controlMulticastSending(transport, network, c)
+}
+
+// ListenPacket listens for UDP datagrams. If the address is a multicast group, it is joined.
+func (transport UDPTransport) ListenPacket(address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: transport.control}
+	pc, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if group, zone, ok := multicastGroup(address); ok {
+		if err := joinMulticastGroup(pc, group, zone, transport.MulticastInterface); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+// DialPacket sets up a UDP connection for sending to an address
+func (transport UDPTransport) DialPacket(address string) (net.Conn, error) {
+	dialer := net.Dialer{Control: transport.control}
+	return dialer.Dial("udp", address)
+}
+
+// ListenStream listens for TCP connections
+func (UDPTransport) ListenStream(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// DialStream opens a TCP connection
+func (UDPTransport) DialStream(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
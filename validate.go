@@ -0,0 +1,125 @@
+package gonetworktest
+
+// Checks of the addresses in a configuration, so mistakes are found at startup rather than by
+// messages silently going nowhere
+import (
+	"fmt"
+	"net"
+)
+
+// riseAndSink is an address that is sent to, and the address that is listened on for it
+type riseAndSink struct {
+	riseName string
+	sinkName string
+}
+
+// riseAndSinkPairs are the addresses that have to match up
+var riseAndSinkPairs = []riseAndSink{
+	{riseName: "HubRiseAddress", sinkName: "AppSinkAddress"},
+	{riseName: "AppRiseAddress", sinkName: "HubSinkAddress"},
+	{riseName: "AppGobRiseAddress", sinkName: "GobSinkAddress"},
+}
+
+// configurationAddresses returns the UDP addresses of a configuration by name
+func configurationAddresses(configuration Configuration) map[string]string {
+	return map[string]string{
+		"HubSinkAddress":    configuration.HubSinkAddress,
+		"HubRiseAddress":    configuration.HubRiseAddress,
+		"AppSinkAddress":    configuration.AppSinkAddress,
+		"AppRiseAddress":    configuration.AppRiseAddress,
+		"GobSinkAddress":    configuration.GobSinkAddress,
+		"AppGobRiseAddress": configuration.AppGobRiseAddress,
+	}
+}
+
+// ValidateConfiguration checks that the addresses of a configuration can be used together. Every
+// address has to parse, with an existing interface for its zone if it has one. Link-local IPv6
+// addresses, and IPv6 multicast groups of interface-local or link-local scope, need an interface,
+// from their zone or from MulticastInterface. Rise addresses are checked against the sink
+// addresses they send to: the ports have to be the same, they have to be of the same IP version,
+// and if one is a multicast group, the other has to be the same group. With unicast fan-out, the
+// Hub sends to where Apps register from, so HubRiseAddress isn't checked against AppSinkAddress.
+func ValidateConfiguration(configuration Configuration) error {
+	if configuration.MulticastTTL < 0 || configuration.MulticastTTL > 255 {
+		return ErrMulticastTTL
+	}
+	if _, err := multicastInterfaceIndex(configuration.MulticastInterface); err != nil {
+		return fmt.Errorf("MulticastInterface %q: %v", configuration.MulticastInterface, err)
+	}
+
+	resolved := make(map[string]*net.UDPAddr)
+	for name, address := range configurationAddresses(configuration) {
+		if address == "" {
+			continue
+		}
+		udpAddress, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := validateZone(udpAddress.IP, udpAddress.Zone, configuration.MulticastInterface); err != nil {
+			return fmt.Errorf("%s %s: %v", name, address, err)
+		}
+		resolved[name] = udpAddress
+	}
+	if configuration.GobTCPAddress != "" {
+		tcpAddress, err := net.ResolveTCPAddr("tcp", configuration.GobTCPAddress)
+		if err != nil {
+			return fmt.Errorf("GobTCPAddress: %v", err)
+		}
+		if err := validateZone(tcpAddress.IP, tcpAddress.Zone, ""); err != nil {
+			return fmt.Errorf("GobTCPAddress %s: %v", configuration.GobTCPAddress, err)
+		}
+	}
+
+	for _, pair := range riseAndSinkPairs {
+		rise, sink := resolved[pair.riseName], resolved[pair.sinkName]
+		if rise == nil || sink == nil {
+			continue
+		}
+		if configuration.HubUnicastFanOut && pair.riseName == "HubRiseAddress" {
+			continue
+		}
+		if err := validateRiseAndSink(rise, sink); err != nil {
+			return fmt.Errorf("%s %s and %s %s: %v", pair.riseName, rise, pair.sinkName, sink, err)
+		}
+	}
+	return nil
+}
+
+// validateZone checks that an address has the interface it needs, and that the interface exists
+func validateZone(ip net.IP, zone string, multicastInterface string) error {
+	if zone != "" {
+		if _, err := multicastInterfaceIndex(zone); err != nil {
+			return err
+		}
+		return nil
+	}
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("link-local address needs an interface zone, like %%eth0")
+	}
+	if ip.To4() == nil && (ip.IsInterfaceLocalMulticast() || ip.IsLinkLocalMulticast()) && multicastInterface == "" {
+		return fmt.Errorf("multicast group of this scope needs an interface zone, like %%eth0, or MulticastInterface")
+	}
+	return nil
+}
+
+// validateRiseAndSink checks that what is sent to the rise address arrives where the sink address
+// listens. An unspecified sink IP listens to anything, but 0.0.0.0 only to IPv4.
+func validateRiseAndSink(rise *net.UDPAddr, sink *net.UDPAddr) error {
+	if rise.Port != sink.Port {
+		return fmt.Errorf("ports differ")
+	}
+	if rise.IP.IsMulticast() || sink.IP.IsMulticast() {
+		if !rise.IP.Equal(sink.IP) {
+			return fmt.Errorf("the sink has to listen on the multicast group that the rise sends to")
+		}
+		return nil
+	}
+	if rise.IP == nil || sink.IP == nil || (sink.IP.IsUnspecified() && sink.IP.To4() == nil) {
+		return nil // Unknown IP version, or listening to both
+	}
+	if (rise.IP.To4() == nil) != (sink.IP.To4() == nil) {
+		return fmt.Errorf("IPv4 and IPv6 are mixed")
+	}
+	return nil
+}
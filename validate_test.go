@@ -0,0 +1,144 @@
+package gonetworktest
+
+import "testing"
+
+// validateConfiguration is a valid IPv4 broadcast configuration, to be changed by each test
+func validateConfiguration() Configuration {
+	return Configuration{
+		HubSinkAddress:    ":9998",
+		HubRiseAddress:    "127.255.255.255:9999",
+		AppSinkAddress:    ":9999",
+		AppRiseAddress:    "127.255.255.255:9998",
+		GobSinkAddress:    ":9996",
+		GobTCPAddress:     ":9996",
+		AppGobRiseAddress: "127.255.255.255:9996",
+	}
+}
+
+// multicastConfiguration sends everything to IPv6 multicast groups, with the zone given
+func multicastConfiguration(hubGroup string, appGroup string, gobGroup string) Configuration {
+	configuration := validateConfiguration()
+	configuration.HubRiseAddress = "[" + hubGroup + "]:9999"
+	configuration.AppSinkAddress = "[" + hubGroup + "]:9999"
+	configuration.AppRiseAddress = "[" + appGroup + "]:9998"
+	configuration.HubSinkAddress = "[" + appGroup + "]:9998"
+	configuration.AppGobRiseAddress = "[" + gobGroup + "]:9996"
+	configuration.GobSinkAddress = "[" + gobGroup + "]:9996"
+	return configuration
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(configuration *Configuration)
+		valid  bool
+	}{
+		{"IPv4 broadcast", func(configuration *Configuration) {}, true},
+		{"site-local groups", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff05::4242", "ff05::4243", "ff05::4244")
+		}, true},
+
+		// Zones
+		{"link-local groups with zone", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff02::4242%lo", "ff02::4243%lo", "ff02::4244%lo")
+		}, true},
+		{"link-local groups with zone by number", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff02::4242%1", "ff02::4243%1", "ff02::4244%1")
+		}, true},
+		{"zone of missing interface", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff02::4242%nosuchinterface", "ff02::4243%lo", "ff02::4244%lo")
+		}, false},
+		{"link-local unicast with zone", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "[fe80::1%lo]:9998"
+			configuration.HubSinkAddress = "[::]:9998"
+		}, true},
+		{"link-local unicast without zone", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "[fe80::1]:9998"
+			configuration.HubSinkAddress = "[::]:9998"
+		}, false},
+		{"Gob TCP address with zone of missing interface", func(configuration *Configuration) {
+			configuration.GobTCPAddress = "[fe80::1%nosuchinterface]:9996"
+		}, false},
+
+		// Groups that need an interface
+		{"link-local groups without interface", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff02::4242", "ff02::4243", "ff02::4244")
+		}, false},
+		{"link-local groups with MulticastInterface", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff02::4242", "ff02::4243", "ff02::4244")
+			configuration.MulticastInterface = "lo"
+		}, true},
+		{"interface-local groups without interface", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff01::4242", "ff01::4243", "ff01::4244")
+		}, false},
+		{"interface-local groups with MulticastInterface", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff01::4242", "ff01::4243", "ff01::4244")
+			configuration.MulticastInterface = "lo"
+		}, true},
+		{"missing MulticastInterface", func(configuration *Configuration) {
+			configuration.MulticastInterface = "nosuchinterface"
+		}, false},
+		{"TTL out of range", func(configuration *Configuration) {
+			configuration.MulticastTTL = 256
+		}, false},
+
+		// IPv4 and IPv6 mixed
+		{"IPv4 rise to IPv6 sink", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "127.0.0.1:9998"
+			configuration.HubSinkAddress = "[::1]:9998"
+		}, false},
+		{"IPv6 rise to IPv4 sink", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "[::1]:9998"
+			configuration.HubSinkAddress = "127.0.0.1:9998"
+		}, false},
+		{"IPv6 rise to sink on 0.0.0.0", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "[::1]:9998"
+			configuration.HubSinkAddress = "0.0.0.0:9998"
+		}, false},
+		{"IPv4 rise to sink on ::", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "127.0.0.1:9998"
+			configuration.HubSinkAddress = "[::]:9998"
+		}, true},
+		{"IPv6 rise to sink without IP", func(configuration *Configuration) {
+			configuration.AppRiseAddress = "[::1]:9998"
+		}, true},
+
+		// Groups and ports that don't match up
+		{"different groups", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff05::4242", "ff05::4243", "ff05::4244")
+			configuration.AppSinkAddress = "[ff05::4245]:9999"
+		}, false},
+		{"group sent to, but not listened on", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff05::4242", "ff05::4243", "ff05::4244")
+			configuration.AppSinkAddress = "[::]:9999"
+		}, false},
+		{"group listened on, but not sent to", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff05::4242", "ff05::4243", "ff05::4244")
+			configuration.AppGobRiseAddress = "[ff05::1]:9996"
+		}, false},
+		{"different ports", func(configuration *Configuration) {
+			configuration.AppGobRiseAddress = "127.255.255.255:9997"
+		}, false},
+		{"unicast fan-out to Apps listening anywhere", func(configuration *Configuration) {
+			*configuration = multicastConfiguration("ff05::4242", "ff05::4243", "ff05::4244")
+			configuration.HubUnicastFanOut = true
+			configuration.AppSinkAddress = "[::]:0"
+		}, true},
+		{"unparsable address", func(configuration *Configuration) {
+			configuration.HubSinkAddress = "[ff05::4242:9998"
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := validateConfiguration()
+			test.change(&configuration)
+			err := ValidateConfiguration(configuration)
+			if test.valid && err != nil {
+				t.Errorf("Expected valid, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}